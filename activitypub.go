@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Each user is an ActivityPub actor named like alice_mastodon.social on this domain.
+// Followers of the actor receive a Create(Note) when the user starts a room.
+
+type (
+	// A remote actor following a local actor
+	APFollower struct {
+		HostID    string    `bson:"host_id" json:"host_id"`
+		Actor     string    `bson:"actor" json:"actor"`
+		Inbox     string    `bson:"inbox" json:"inbox"`
+		CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	}
+
+	// Keys of the local actor, stored in the user document but not in AudonUser not to be exposed
+	APActorKey struct {
+		PrivateKey string `bson:"ap_private_key"`
+		PublicKey  string `bson:"ap_public_key"`
+	}
+
+	// Fields of remote actors used by Audon
+	APRemoteActor struct {
+		ID        string `json:"id"`
+		Inbox     string `json:"inbox"`
+		Endpoints struct {
+			SharedInbox string `json:"sharedInbox"`
+		} `json:"endpoints"`
+		PublicKey struct {
+			ID           string `json:"id"`
+			Owner        string `json:"owner"`
+			PublicKeyPem string `json:"publicKeyPem"`
+		} `json:"publicKey"`
+	}
+
+	// Incoming activity, object is either an ID or an embedded object
+	APActivity struct {
+		ID     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+)
+
+const (
+	AP_CONTENT_TYPE  = "application/activity+json"
+	AP_PUBLIC        = "https://www.w3.org/ns/activitystreams#Public"
+	AP_OUTBOX_LENGTH = 20
+)
+
+var AP_CONTEXT = []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}
+
+// Client for servers given by users, e.g. remote actors and inboxes or the server to log in to.
+// It doesn't follow proxies so that local addresses are always checked.
+var apHTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: denyLocalAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// handler for GET to /ap/users/:name
+func getActorHandler(c echo.Context) error {
+	user, err := findUserByActorName(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		return ErrUserNotFound
+	}
+	key, err := getActorKey(c.Request().Context(), user)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	actorID := user.ActorURL()
+	actor := map[string]any{
+		"@context":                  AP_CONTEXT,
+		"id":                        actorID,
+		"type":                      "Service",
+		"preferredUsername":         user.ActorName(),
+		"name":                      user.Webfinger,
+		"summary":                   fmt.Sprintf(`<p>Notifies when <a href="%s">@%s</a> goes live on Audon.</p>`, html.EscapeString(user.RemoteURL), html.EscapeString(user.Webfinger)),
+		"url":                       user.ProfileURL(),
+		"inbox":                     actorID + "/inbox",
+		"outbox":                    actorID + "/outbox",
+		"followers":                 actorID + "/followers",
+		"manuallyApprovesFollowers": false,
+		"discoverable":              true,
+		"publicKey": map[string]string{
+			"id":           actorID + "#main-key",
+			"owner":        actorID,
+			"publicKeyPem": key.PublicKey,
+		},
+	}
+
+	return respondActivity(c, actor)
+}
+
+// handler for GET to /ap/users/:name/followers, only the number is public
+func getFollowersHandler(c echo.Context) error {
+	user, err := findUserByActorName(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		return ErrUserNotFound
+	}
+	count, err := mainDB.Collection(COLLECTION_AP_FOLLOWER).CountDocuments(c.Request().Context(),
+		bson.D{{Key: "host_id", Value: user.AudonID}})
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return respondActivity(c, map[string]any{
+		"@context":   AP_CONTEXT[0],
+		"id":         user.ActorURL() + "/followers",
+		"type":       "OrderedCollection",
+		"totalItems": count,
+	})
+}
+
+// handler for GET to /ap/users/:name/outbox, returns notes of the recent public rooms
+func getOutboxHandler(c echo.Context) error {
+	user, err := findUserByActorName(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(AP_OUTBOX_LENGTH)
+	cur, err := coll.Find(c.Request().Context(), bson.D{
+		{Key: "host.audon_id", Value: user.AudonID},
+		{Key: "restriction", Value: EVERYONE},
+	}, opts)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	var rooms []*Room
+	if err := cur.All(c.Request().Context(), &rooms); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	items := make([]map[string]any, 0, len(rooms))
+	for _, r := range rooms {
+		// the first start of the room, the start time of LiveKit is not stored
+		items = append(items, r.createNoteActivity(r.CreatedAt.Unix()))
+	}
+
+	return respondActivity(c, map[string]any{
+		"@context":     AP_CONTEXT[0],
+		"id":           user.ActorURL() + "/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	})
+}
+
+// handler for GET to /ap/notes/:id
+func getNoteHandler(c echo.Context) error {
+	room, err := findRoomByID(c.Request().Context(), c.Param("id"))
+	if err != nil || room.Restriction != EVERYONE {
+		return ErrRoomNotFound
+	}
+
+	note := room.note()
+	note["@context"] = AP_CONTEXT[0]
+	return respondActivity(c, note)
+}
+
+// handler for POST to /ap/users/:name/inbox
+// Only Follow and Undo(Follow) are handled, other activities are accepted and ignored.
+func postInboxHandler(c echo.Context) error {
+	user, err := findUserByActorName(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, 1<<20))
+	if err != nil {
+		return ErrInvalidRequestFormat
+	}
+	var activity APActivity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		return ErrInvalidRequestFormat
+	}
+
+	sender, err := verifyInboxRequest(c.Request(), body, user)
+	if err != nil {
+		c.Logger().Warn(err)
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid_signature")
+	}
+	if sender.ID != activity.Actor {
+		return echo.NewHTTPError(http.StatusForbidden, "actor_mismatch")
+	}
+
+	switch activity.Type {
+	case "Follow":
+		if activityObjectID(activity.Object) != user.ActorURL() {
+			return c.NoContent(http.StatusAccepted)
+		}
+		if err := user.addFollower(c.Request().Context(), sender); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		go func(u *AudonUser, inbox string, follow json.RawMessage) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			accept := map[string]any{
+				"@context": AP_CONTEXT[0],
+				"id":       fmt.Sprintf("%s#accepts/%d", u.ActorURL(), time.Now().UnixNano()),
+				"type":     "Accept",
+				"actor":    u.ActorURL(),
+				"object":   follow,
+			}
+			if err := deliverActivity(ctx, u, inbox, accept); err != nil {
+				log.Println(err)
+			}
+		}(user, sender.Inbox, json.RawMessage(body))
+	case "Undo":
+		var undone APActivity
+		if err := json.Unmarshal(activity.Object, &undone); err != nil || undone.Type != "Follow" {
+			return c.NoContent(http.StatusAccepted)
+		}
+		if _, err := mainDB.Collection(COLLECTION_AP_FOLLOWER).DeleteOne(c.Request().Context(), bson.D{
+			{Key: "host_id", Value: user.AudonID},
+			{Key: "actor", Value: sender.ID},
+		}); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// Queues Create(Note) of the room to all followers of the host.
+// startedAt distinguishes the deliveries of a resumed room, like the announcements of the bot.
+func publishRoomStarted(ctx context.Context, room *Room, startedAt int64) error {
+	coll := mainDB.Collection(COLLECTION_AP_FOLLOWER)
+	cur, err := coll.Find(ctx, bson.D{{Key: "host_id", Value: room.Host.AudonID}})
+	if err != nil {
+		return err
+	}
+	var followers []*APFollower
+	if err := cur.All(ctx, &followers); err != nil {
+		return err
+	}
+	if len(followers) == 0 {
+		return nil
+	}
+
+	activity := room.createNoteActivity(startedAt)
+	activity["@context"] = AP_CONTEXT[0]
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	// followers on the same server share the inbox
+	inboxes := make(map[string]bool)
+	for _, f := range followers {
+		if inboxes[f.Inbox] {
+			continue
+		}
+		inboxes[f.Inbox] = true
+		if err := enqueueBotPost(ctx, &OutboxPost{
+			Key:      outboxKey(room.RoomID, OUTBOX_ACTIVITY, startedAt, f.Inbox),
+			RoomID:   room.RoomID,
+			Kind:     OUTBOX_ACTIVITY,
+			Sender:   room.Host.AudonID,
+			Inbox:    f.Inbox,
+			Activity: string(body),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startedAt is put in the ID so that remote servers don't drop the activity of a resumed room as a duplicate
+func (r *Room) createNoteActivity(startedAt int64) map[string]any {
+	note := r.note()
+	return map[string]any{
+		"id":        fmt.Sprintf("%s/activity/%d", note["id"], startedAt),
+		"type":      "Create",
+		"actor":     note["attributedTo"],
+		"published": note["published"],
+		"to":        note["to"],
+		"cc":        note["cc"],
+		"object":    note,
+	}
+}
+
+func (r *Room) note() map[string]any {
+	localizer := i18n.NewLocalizer(localeBundle, r.Advertise)
+	header := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "Advertise",
+			Other: "@{{.Host}} is streaming now!",
+		},
+		TemplateData: map[string]string{
+			"Host": r.Host.Webfinger,
+		},
+	})
+	link := r.Host.ProfileURL()
+	paragraphs := []string{
+		html.EscapeString(header),
+		fmt.Sprintf(`%s<br><a href="%s">%s</a>`, html.EscapeString(r.Title), html.EscapeString(link), html.EscapeString(link)),
+	}
+	if r.Description != "" {
+		paragraphs = append(paragraphs, strings.ReplaceAll(html.EscapeString(r.Description), "\n", "<br>"))
+	}
+
+	actorID := r.Host.ActorURL()
+	note := map[string]any{
+		"id":           localURL("ap", "notes", r.RoomID),
+		"type":         "Note",
+		"attributedTo": actorID,
+		"content":      "<p>" + strings.Join(paragraphs, "</p><p>") + "</p>",
+		"url":          localURL("r", r.RoomID),
+		"published":    r.CreatedAt.UTC().Format(time.RFC3339),
+		"to":           []string{AP_PUBLIC},
+		"cc":           []string{actorID + "/followers"},
+	}
+	if r.Advertise != "" {
+		note["contentMap"] = map[string]string{r.Advertise: note["content"].(string)}
+	}
+	return note
+}
+
+func (a *AudonUser) addFollower(ctx context.Context, actor *APRemoteActor) error {
+	inbox := actor.Endpoints.SharedInbox
+	if inbox == "" {
+		inbox = actor.Inbox
+	}
+	if inbox == "" {
+		return errors.New("inbox not found")
+	}
+
+	coll := mainDB.Collection(COLLECTION_AP_FOLLOWER)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "host_id", Value: a.AudonID}, {Key: "actor", Value: actor.ID}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "inbox", Value: inbox}}},
+			{Key: "$setOnInsert", Value: bson.D{{Key: "created_at", Value: time.Now().UTC()}}},
+		},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// Verifies the signature with the key of the sender and returns the sender.
+// Remote actors are fetched with a request signed by the local actor for servers requiring authorized fetch.
+// The key, the actor and the owner of the key must be on the same host, otherwise anyone could claim others' actors.
+func verifyInboxRequest(req *http.Request, body []byte, local *AudonUser) (*APRemoteActor, error) {
+	params, err := parseSignatureHeader(req)
+	if err != nil {
+		return nil, err
+	}
+	keyURL, err := url.Parse(params["keyId"])
+	if err != nil {
+		return nil, err
+	}
+	keyURL.Fragment = ""
+	sender, err := fetchRemoteActor(req.Context(), local, keyURL.String())
+	if err != nil {
+		return nil, err
+	}
+	// some software serves only the key at keyId, the actor is its owner
+	if sender.Inbox == "" && sender.PublicKey.Owner != "" && sender.PublicKey.Owner != sender.ID {
+		if !sameHost(keyURL.String(), sender.PublicKey.Owner) {
+			return nil, errors.New("key owner on another host")
+		}
+		owner, err := fetchRemoteActor(req.Context(), local, sender.PublicKey.Owner)
+		if err != nil {
+			return nil, err
+		}
+		if owner.PublicKey.PublicKeyPem != sender.PublicKey.PublicKeyPem {
+			return nil, errors.New("key owner mismatch")
+		}
+		sender = owner
+	}
+	if !sameHost(keyURL.String(), sender.ID) || (sender.PublicKey.Owner != "" && sender.PublicKey.Owner != sender.ID) {
+		return nil, errors.New("key not owned by the actor")
+	}
+
+	if err := verifySignature(req, body, params, sender.PublicKey.PublicKeyPem); err != nil {
+		return nil, err
+	}
+	return sender, nil
+}
+
+func fetchRemoteActor(ctx context.Context, signer *AudonUser, actorURL string) (*APRemoteActor, error) {
+	req, err := http.NewRequest(http.MethodGet, actorURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", AP_CONTENT_TYPE)
+	req.Header.Set("User-Agent", USER_AGENT)
+	if err := signActorRequest(ctx, req, nil, signer); err != nil {
+		return nil, err
+	}
+	resp, err := apHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed: %d", resp.StatusCode)
+	}
+
+	var actor APRemoteActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&actor); err != nil {
+		return nil, err
+	}
+	if actor.ID == "" || actor.PublicKey.PublicKeyPem == "" {
+		return nil, errors.New("invalid actor")
+	}
+	// the document must come from the host of its id
+	if !sameHost(actorURL, actor.ID) {
+		return nil, errors.New("actor id on another host")
+	}
+	return &actor, nil
+}
+
+func deliverActivity(ctx context.Context, sender *AudonUser, inbox string, activity any) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", AP_CONTENT_TYPE)
+	req.Header.Set("User-Agent", USER_AGENT)
+	if err := signActorRequest(ctx, req, body, sender); err != nil {
+		return err
+	}
+	resp, err := apHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("delivery to %s failed: %d", inbox, resp.StatusCode)
+	}
+	return nil
+}
+
+// Returns true if both URLs are valid and have the same host
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil || ua.Host == "" {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Host, ub.Host)
+}
+
+// Refuses connections to loopback and private addresses, as remote URLs come from anyone's activities.
+// Checked after resolving the name, so that names pointing to local addresses are also refused.
+func denyLocalAddress(network, address string, _ syscall.RawConn) error {
+	// the test inbox is on localhost
+	if mainConfig.Environment == "development" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("connection to %s denied", host)
+	}
+	return nil
+}
+
+func signActorRequest(ctx context.Context, req *http.Request, body []byte, signer *AudonUser) error {
+	key, err := getActorKey(ctx, signer)
+	if err != nil {
+		return err
+	}
+	privateKey, err := parsePrivateKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return signRequest(req, body, signer.ActorURL()+"#main-key", privateKey)
+}
+
+// Returns the key pair of the actor, generated on the first call
+func getActorKey(ctx context.Context, user *AudonUser) (*APActorKey, error) {
+	coll := mainDB.Collection(COLLECTION_USER)
+	opts := options.FindOne().SetProjection(bson.D{{Key: "ap_private_key", Value: 1}, {Key: "ap_public_key", Value: 1}})
+	var key APActorKey
+	if err := coll.FindOne(ctx, bson.D{{Key: "audon_id", Value: user.AudonID}}, opts).Decode(&key); err != nil {
+		return nil, err
+	}
+	if key.PrivateKey != "" {
+		return &key, nil
+	}
+
+	privatePem, publicPem, err := generateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	// another request may have generated the key in the meantime
+	result, err := coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "audon_id", Value: user.AudonID},
+			{Key: "ap_private_key", Value: bson.D{{Key: "$exists", Value: false}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "ap_private_key", Value: privatePem},
+			{Key: "ap_public_key", Value: publicPem},
+		}}})
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount == 0 {
+		return getActorKey(ctx, user)
+	}
+
+	return &APActorKey{PrivateKey: privatePem, PublicKey: publicPem}, nil
+}
+
+func respondActivity(c echo.Context, v any) error {
+	c.Response().Header().Set(echo.HeaderContentType, AP_CONTENT_TYPE+"; charset=utf-8")
+	return c.JSON(http.StatusOK, v)
+}
+
+func activityObjectID(object json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(object, &id); err == nil {
+		return id
+	}
+	var embedded struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(object, &embedded)
+	return embedded.ID
+}
+
+// Returns the name of the actor, e.g. alice_mastodon.social for alice@mastodon.social
+func (a *AudonUser) ActorName() string {
+	i := strings.LastIndex(a.Webfinger, "@")
+	if i < 0 {
+		return a.Webfinger
+	}
+	return a.Webfinger[:i] + "_" + a.Webfinger[i+1:]
+}
+
+func (a *AudonUser) ActorURL() string {
+	return localURL("ap", "users", a.ActorName())
+}
+
+// Domains cannot contain underscores, so the last one separates the username and the domain
+func findUserByActorName(ctx context.Context, name string) (*AudonUser, error) {
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return findUserByWebfinger(ctx, name[:i]+"@"+name[i+1:])
+}
+
+func findUserByActorURL(ctx context.Context, actorURL string) (*AudonUser, error) {
+	u, err := url.Parse(actorURL)
+	if err != nil || !strings.EqualFold(u.Host, mainConfig.LocalDomain) || !strings.HasPrefix(u.Path, "/ap/users/") {
+		return nil, mongo.ErrNoDocuments
+	}
+	return findUserByActorName(ctx, strings.TrimPrefix(u.Path, "/ap/users/"))
+}
+
+// handler for POST to /ap/test/inbox, only in development.
+// Stands in for remote inboxes, verifies the signature and logs the activity.
+func testInboxHandler(c echo.Context) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, 1<<20))
+	if err != nil {
+		return ErrInvalidRequestFormat
+	}
+	params, err := parseSignatureHeader(c.Request())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	signer, err := findUserByActorURL(c.Request().Context(), params["keyId"])
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "unknown_key")
+	}
+	key, err := getActorKey(c.Request().Context(), signer)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := verifySignature(c.Request(), body, params, key.PublicKey); err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+
+	c.Logger().Infof("test inbox received from %s: %s", signer.ActorURL(), body)
+	return c.NoContent(http.StatusAccepted)
+}
+
+// handler for POST to /ap/test/users/:name/follow, only in development.
+// Makes the test inbox follow the actor so that notes can be checked without remote servers.
+func testFollowHandler(c echo.Context) error {
+	user, err := findUserByActorName(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		return ErrUserNotFound
+	}
+	follower := &APRemoteActor{
+		ID:    localURL("ap", "test", "follower"),
+		Inbox: localURL("ap", "test", "inbox"),
+	}
+	if err := user.addFollower(c.Request().Context(), follower); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// How the bot announces rooms. The admin sets the defaults in the config and hosts can override them.
+	// Empty fields of the host's settings fall back to the defaults.
+	AnnouncementConfig struct {
+		Template         string   `bson:"template" json:"template" validate:"max=1000"`
+		FollowUpTemplate string   `bson:"follow_up_template" json:"follow_up_template" validate:"max=500"`
+		SpoilerText      string   `bson:"spoiler_text" json:"spoiler_text" validate:"max=200"`
+		Visibility       string   `bson:"visibility" json:"visibility" validate:"omitempty,oneof=public unlisted private"`
+		Hashtags         []string `bson:"hashtags" json:"hashtags" validate:"max=10,dive,required,max=50,excludesall=# "`
+		FollowUp         *bool    `bson:"follow_up" json:"follow_up"`
+	}
+
+	// Fields available in the templates
+	AnnouncementData struct {
+		Host        string
+		Title       string
+		Description string
+		URL         string
+		Language    string
+		Minutes     int // length of the room, only in follow-ups
+	}
+)
+
+var (
+	// The templates of the admin, localized through localeBundle
+	announcementMessage = &i18n.Message{
+		ID:    "Announcement",
+		Other: "@{{.Host}} is streaming now!\n\n:udon: {{.Title}}\n🎙️ {{.URL}}{{if .Description}}\n\n{{.Description}}{{end}}",
+	}
+	announcementFollowUpMessage = &i18n.Message{
+		ID:    "AnnouncementFollowUp",
+		Other: "This room has ended after {{.Minutes}} minute(s). Thank you for listening!",
+	}
+
+	errAnnouncementDisabled = errors.New("announcement disabled")
+)
+
+const (
+	// Limits of the text rendered from the host's templates, the hashtags are not counted
+	ANNOUNCEMENT_MAX_LENGTH = 500
+	SPOILER_TEXT_MAX_LENGTH = 200
+)
+
+// handler for GET to /api/announcement
+func getAnnouncementConfigHandler(c echo.Context) error {
+	user := c.Get("user").(*AudonUser)
+
+	conf, err := findUserAnnouncementConfig(c.Request().Context(), user.AudonID)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, M{
+		"host":    conf,
+		"default": mainConfig.Bot.Announcement,
+	})
+}
+
+// handler for PUT to /api/announcement
+func updateAnnouncementConfigHandler(c echo.Context) error {
+	req := new(AnnouncementConfig)
+	if err := c.Bind(req); err != nil {
+		return ErrInvalidRequestFormat
+	}
+	if err := mainValidator.Struct(req); err != nil {
+		return wrapValidationError(err)
+	}
+	// templates are checked here, not to fail when the room starts
+	sample := &AnnouncementData{Host: "audon@example.com", Title: "Audon", URL: localURL()}
+	for _, t := range []string{req.Template, req.FollowUpTemplate, req.SpoilerText} {
+		if _, err := executeAnnouncementTemplate(t, sample); err != nil {
+			return ErrInvalidTemplate
+		}
+	}
+
+	user := c.Get("user").(*AudonUser)
+	coll := mainDB.Collection(COLLECTION_USER)
+	if _, err := coll.UpdateOne(c.Request().Context(),
+		bson.D{{Key: "audon_id", Value: user.AudonID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "announcement", Value: req}}}},
+	); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// Queues the announcement of the room. startedAt distinguishes the announcements of a resumed room.
+func queueAnnouncement(ctx context.Context, room *Room, startedAt int64) error {
+	conf, err := getAnnouncementConfig(ctx, room.Host)
+	if err != nil {
+		return err
+	}
+
+	data := room.announcementData()
+	localizer := i18n.NewLocalizer(localeBundle, room.Advertise)
+	defaults := mainConfig.Bot.Announcement
+	message, err := renderAnnouncement(localizer, conf.Template, conf.Template != defaults.Template, announcementMessage, data)
+	if err != nil {
+		return err
+	}
+	spoilerText, err := executeAnnouncementTemplate(conf.SpoilerText, data)
+	if err != nil {
+		return err
+	}
+	if conf.SpoilerText != defaults.SpoilerText {
+		spoilerText = sanitizeHostText(spoilerText, data.URL, SPOILER_TEXT_MAX_LENGTH)
+	}
+	if len(conf.Hashtags) > 0 {
+		message = strings.Join([]string{message, formatHashtags(conf.Hashtags)}, "\n\n")
+	}
+
+	key := outboxKey(room.RoomID, OUTBOX_ANNOUNCEMENT, startedAt)
+	if err := enqueueBotPost(ctx, &OutboxPost{
+		Key:         key,
+		RoomID:      room.RoomID,
+		Kind:        OUTBOX_ANNOUNCEMENT,
+		Bot:         mainConfig.Bot.AccountFor(room).Tag,
+		Status:      message,
+		SpoilerText: spoilerText,
+		Language:    room.Advertise,
+		Visibility:  conf.Visibility,
+	}); err != nil {
+		return err
+	}
+
+	// the follow-up is queued with this key even if the announcement has not been sent yet
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	_, err = coll.UpdateOne(ctx,
+		bson.D{{Key: "room_id", Value: room.RoomID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "announcement_key", Value: key}}}},
+	)
+	return err
+}
+
+// Queues the reply to the announcement of the room, if the host or the admin enabled follow-ups
+func queueAnnouncementFollowUp(ctx context.Context, roomID string) error {
+	// rooms taken from LiveKit metadata don't have the announcement
+	room, err := findRoomByID(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if room.AnnouncementKey == "" && room.AnnouncementID == "" {
+		return nil
+	}
+	conf, err := getAnnouncementConfig(ctx, room.Host)
+	if err != nil {
+		return err
+	}
+	if conf.FollowUp == nil || !*conf.FollowUp {
+		return nil
+	}
+
+	data := room.announcementData()
+	localizer := i18n.NewLocalizer(localeBundle, room.Advertise)
+	message, err := renderAnnouncement(localizer, conf.FollowUpTemplate, conf.FollowUpTemplate != mainConfig.Bot.Announcement.FollowUpTemplate, announcementFollowUpMessage, data)
+	if err != nil {
+		return err
+	}
+
+	post := &OutboxPost{
+		RoomID:     room.RoomID,
+		Kind:       OUTBOX_FOLLOW_UP,
+		Status:     message,
+		Language:   room.Advertise,
+		Visibility: conf.Visibility,
+	}
+	// only one reply to each announcement even if the room is resumed and ended again
+	if room.AnnouncementKey != "" {
+		// the outbox sends this after the announcement
+		post.Key = outboxKey(room.RoomID, OUTBOX_FOLLOW_UP, room.AnnouncementKey)
+		post.ParentKey = room.AnnouncementKey
+	} else {
+		// announced before the key was stored
+		post.Key = outboxKey(room.RoomID, OUTBOX_FOLLOW_UP, room.AnnouncementID)
+		post.Bot = room.AnnouncementBot // only the same bot can reply
+		post.InReplyToID = room.AnnouncementID
+	}
+	return enqueueBotPost(ctx, post)
+}
+
+// Returns the settings of the host merged with the defaults
+func getAnnouncementConfig(ctx context.Context, host *AudonUser) (*AnnouncementConfig, error) {
+	if !mainConfig.Bot.Enable {
+		return nil, errAnnouncementDisabled
+	}
+	hostConf, err := findUserAnnouncementConfig(ctx, host.AudonID)
+	if err != nil {
+		log.Println(err)
+	}
+	return hostConf.merge(mainConfig.Bot.Announcement), nil
+}
+
+func findUserAnnouncementConfig(ctx context.Context, audonID string) (*AnnouncementConfig, error) {
+	var result struct {
+		Announcement *AnnouncementConfig `bson:"announcement"`
+	}
+	coll := mainDB.Collection(COLLECTION_USER)
+	opts := options.FindOne().SetProjection(bson.D{{Key: "announcement", Value: 1}})
+	if err := coll.FindOne(ctx, bson.D{{Key: "audon_id", Value: audonID}}, opts).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Announcement == nil {
+		return &AnnouncementConfig{}, nil
+	}
+	return result.Announcement, nil
+}
+
+func (a *AnnouncementConfig) merge(defaults *AnnouncementConfig) *AnnouncementConfig {
+	merged := *defaults
+	if a == nil {
+		return &merged
+	}
+	if a.Template != "" {
+		merged.Template = a.Template
+	}
+	if a.FollowUpTemplate != "" {
+		merged.FollowUpTemplate = a.FollowUpTemplate
+	}
+	if a.SpoilerText != "" {
+		merged.SpoilerText = a.SpoilerText
+	}
+	if a.Visibility != "" {
+		merged.Visibility = a.Visibility
+	}
+	if a.Hashtags != nil {
+		merged.Hashtags = a.Hashtags
+	}
+	if a.FollowUp != nil {
+		merged.FollowUp = a.FollowUp
+	}
+	return &merged
+}
+
+func (r *Room) announcementData() *AnnouncementData {
+	data := &AnnouncementData{
+		Host:        r.Host.Webfinger,
+		Title:       r.Title,
+		Description: r.Description,
+		URL:         r.Host.ProfileURL(),
+		Language:    r.Advertise,
+	}
+	if !r.EndedAt.IsZero() {
+		data.Minutes = int(r.EndedAt.Sub(r.CreatedAt).Round(time.Minute).Minutes())
+	}
+	return data
+}
+
+// Renders the template of the host or the admin's localized one if the host has none
+func renderAnnouncement(localizer *i18n.Localizer, tmpl string, byHost bool, defaultMessage *i18n.Message, data *AnnouncementData) (string, error) {
+	if tmpl != "" {
+		text, err := executeAnnouncementTemplate(tmpl, data)
+		if err != nil || !byHost {
+			return text, err
+		}
+		return sanitizeHostText(text, data.URL, ANNOUNCEMENT_MAX_LENGTH), nil
+	}
+	message, err := localizer.Localize(&i18n.LocalizeConfig{
+		DefaultMessage: defaultMessage,
+		TemplateData:   data,
+	})
+	// the message in the default language is returned if the admin hasn't translated it
+	var notFound *i18n.MessageNotFoundErr
+	if errors.As(err, &notFound) {
+		return message, nil
+	}
+	return message, err
+}
+
+func executeAnnouncementTemplate(tmpl string, data *AnnouncementData) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+	t, err := template.New("announcement").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Keeps the text written by the host from mentioning or linking anyone through the bot, except the room URL,
+// and cuts it at maxLength characters
+func sanitizeHostText(text, roomURL string, maxLength int) string {
+	text = escapeLinks(escapeMentions(text))
+	if runes := []rune(text); len(runes) > maxLength {
+		text = string(runes[:maxLength-1]) + "…"
+	}
+	// the URL left broken by the cut stays unlinked
+	if roomURL != "" {
+		text = strings.ReplaceAll(text, escapeLinks(escapeMentions(roomURL)), roomURL)
+	}
+	return text
+}
+
+func formatHashtags(tags []string) string {
+	formatted := make([]string, 0, len(tags))
+	for _, t := range tags {
+		formatted = append(formatted, "#"+t)
+	}
+	return strings.Join(formatted, " ")
+}
@@ -40,6 +40,16 @@ const router = createRouter({
       name: "create",
       component: () => import("../views/CreateView.vue"),
     },
+    {
+      path: "/subscriptions",
+      name: "subscriptions",
+      component: () => import("../views/SubscriptionsView.vue"),
+    },
+    {
+      path: "/announcement",
+      name: "announcement",
+      component: () => import("../views/AnnouncementView.vue"),
+    },
     {
       path: "/r/:id",
       name: "room",
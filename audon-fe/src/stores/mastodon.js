@@ -2,6 +2,7 @@ import { defineStore } from "pinia";
 import axios from "axios";
 import { createClient } from "masto";
 import { webfinger } from "../assets/utils";
+import { camelCase, mapKeys } from "lodash-es";
 
 export const useMastodonStore = defineStore("mastodon", {
   state() {
@@ -36,6 +37,14 @@ export const useMastodonStore = defineStore("mastodon", {
     async fetchToken() {
       const resp = await axios.get("/api/token");
       this.oauth = resp.data;
+      if (this.oauth.software === "misskey") {
+        // Misskey doesn't support Mastodon API, the server converts the profile instead
+        const verify = await axios.get("/app/verify");
+        this.client = null;
+        this.userinfo = mapKeys(verify.data, (_, key) => camelCase(key));
+        this.authorized = true;
+        return;
+      }
       const client = createClient({
         url: this.oauth.url,
         accessToken: this.oauth.token,
@@ -2,16 +2,15 @@ package main
 
 import (
 	"crypto/rand"
-	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
 	"github.com/labstack/echo/v4"
 	mastodon "github.com/mattn/go-mastodon"
 	"github.com/oklog/ulid/v2"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -21,15 +20,15 @@ func verifyTokenInSession(c echo.Context) (bool, *mastodon.Account, error) {
 		return false, nil, err
 	}
 
-	mastoClient := getMastodonClient(data)
-	if mastoClient == nil {
+	if data.MastodonConfig == nil || data.MastodonConfig.AccessToken == "" {
 		return false, nil, nil
 	}
 
-	acc, err := mastoClient.GetAccountCurrentUser(c.Request().Context())
-	acctUrl, _ := url.Parse(acc.URL)
-	finger := strings.Split(acc.Username, "@")
-	webfinger := fmt.Sprintf("%s@%s", finger[0], acctUrl.Host)
+	acc, err := getProvider(data.Software).GetCurrentAccount(c.Request().Context(), data.MastodonConfig)
+	if err != nil {
+		return false, nil, err
+	}
+	webfinger := accountWebfinger(acc)
 	user, dbErr := findUserByID(c.Request().Context(), data.AudonID)
 
 	if err != nil || dbErr != nil || webfinger != user.Webfinger {
@@ -42,6 +41,7 @@ func verifyTokenInSession(c echo.Context) (bool, *mastodon.Account, error) {
 type LoginRequest struct {
 	ServerHost string `validate:"required,fqdn" form:"server"`
 	Redirect   string `validate:"url_encoded" form:"redir"`
+	LiveAvatar bool   `form:"avatar"`
 }
 
 // handler for POST to /app/login
@@ -66,50 +66,43 @@ func loginHandler(c echo.Context) (err error) {
 			req.Redirect = "/"
 		}
 
-		appConfig, err := getAppConfig(serverURL.String())
-		if err != nil {
-			return ErrInvalidRequestFormat
-		}
-		// mastApp, err := mastodon.RegisterApp(c.Request().Context(), appConfig)
-		mastApp, err := registerApp(c.Request().Context(), appConfig)
+		software, err := detectSoftware(c.Request().Context(), serverURL)
 		if err != nil {
+			// servers without NodeInfo are regarded as Mastodon as before
 			c.Logger().Warn(err)
-			return echo.NewHTTPError(http.StatusNotFound, "server_not_found")
+			software = SOFTWARE_MASTODON
 		}
 
 		userSession := &SessionData{
 			MastodonConfig: &mastodon.Config{
-				Server:       serverURL.String(),
-				ClientID:     mastApp.ClientID,
-				ClientSecret: mastApp.ClientSecret,
+				Server: serverURL.String(),
 			},
+			LiveAvatar: req.LiveAvatar,
+			Software:   software,
+		}
+		redirURL, err := getProvider(software).Authorize(c.Request().Context(), userSession, req.Redirect)
+		if err != nil {
+			c.Logger().Warn(err)
+			return echo.NewHTTPError(http.StatusNotFound, "server_not_found")
 		}
 		if err = writeSessionData(c, userSession); err != nil {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusInternalServerError)
 		}
 
-		redirURL, err := url.Parse(mastApp.AuthURI)
-		if err != nil {
-			c.Logger().Warn(err)
-			return echo.NewHTTPError(http.StatusInternalServerError, "invalid_auth_uri")
-		}
-		q := redirURL.Query()
-		q.Add("state", req.Redirect)
-		redirURL.RawQuery = q.Encode()
-
-		return c.String(http.StatusCreated, redirURL.String())
+		return c.String(http.StatusCreated, redirURL)
 	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
 type OAuthRequest struct {
-	Code  string `query:"code"`
-	State string `query:"state"`
+	Code    string `query:"code"`
+	State   string `query:"state"`
+	Session string `query:"session"` // MiAuth
 }
 
-// handler for GET to /app/oauth?code=****
+// handler for GET to /app/oauth?code=**** or ?session=**** from MiAuth
 func oauthHandler(c echo.Context) (err error) {
 	req := new(OAuthRequest)
 
@@ -117,7 +110,7 @@ func oauthHandler(c echo.Context) (err error) {
 		return ErrInvalidRequestFormat
 	}
 
-	if req.Code == "" {
+	if req.Code == "" && req.Session == "" {
 		if errMsg := c.QueryParam("error"); errMsg == "access_denied" {
 			return c.Redirect(http.StatusFound, "/login")
 		}
@@ -131,29 +124,22 @@ func oauthHandler(c echo.Context) (err error) {
 	if err != nil {
 		return err
 	}
-	appConf, err := getAppConfig(data.MastodonConfig.Server)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	if data.MastodonConfig == nil {
+		return ErrInvalidSession
 	}
 
-	data.AuthCode = req.Code
-	client := mastodon.NewClient(data.MastodonConfig)
-	client.UserAgent = USER_AGENT
-	err = client.AuthenticateToken(c.Request().Context(), req.Code, appConf.RedirectURIs)
-	if err != nil {
+	provider := getProvider(data.Software)
+	if err = provider.Authenticate(c.Request().Context(), data, req); err != nil {
 		return echo.NewHTTPError(http.StatusForbidden, err.Error())
 	}
-	data.MastodonConfig = client.Config
 
-	acc, err := client.GetAccountCurrentUser(c.Request().Context())
+	acc, err := provider.GetCurrentAccount(c.Request().Context(), data.MastodonConfig)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusForbidden, err.Error())
 	}
 
 	coll := mainDB.Collection(COLLECTION_USER)
-	acctUrl, _ := url.Parse(acc.URL)
-	finger := strings.Split(acc.Username, "@")
-	webfinger := fmt.Sprintf("%s@%s", finger[0], acctUrl.Host)
+	webfinger := accountWebfinger(acc)
 	if result, dbErr := findUserByWebfinger(c.Request().Context(), webfinger); dbErr == mongo.ErrNoDocuments {
 		entropy := ulid.Monotonic(rand.Reader, 0)
 		id, err := ulid.New(ulid.Timestamp(time.Now().UTC()), entropy)
@@ -163,11 +149,12 @@ func oauthHandler(c echo.Context) (err error) {
 		}
 		data.AudonID = id.String()
 		newUser := AudonUser{
-			AudonID:   data.AudonID,
-			RemoteID:  string(acc.ID),
-			RemoteURL: acc.URL,
-			Webfinger: webfinger,
-			CreatedAt: time.Now().UTC(),
+			AudonID:    data.AudonID,
+			RemoteID:   string(acc.ID),
+			RemoteURL:  acc.URL,
+			Webfinger:  webfinger,
+			LiveAvatar: data.LiveAvatar,
+			CreatedAt:  time.Now().UTC(),
 		}
 		if _, insertErr := coll.InsertOne(c.Request().Context(), newUser); insertErr != nil {
 			c.Logger().Error(insertErr)
@@ -181,6 +168,42 @@ func oauthHandler(c echo.Context) (err error) {
 		data.AudonID = result.AudonID
 	}
 
+	// Store the token of users enabling the live avatar, so that the server can restore the avatar after a restart,
+	// and of hosts whose rooms check the blocks or the list
+	keepToken := data.LiveAvatar
+	if !keepToken {
+		keepToken, err = (&AudonUser{AudonID: data.AudonID}).HostsRoomNeedingCredential(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+	if keepToken {
+		_, err = coll.UpdateOne(c.Request().Context(),
+			bson.D{{Key: "audon_id", Value: data.AudonID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "live_avatar", Value: data.LiveAvatar}}}})
+		if err == nil {
+			err = storeUserCredential(c.Request().Context(), data)
+		}
+	} else {
+		// the token stored before is kept until the avatar on air is restored
+		_, err = coll.UpdateOne(c.Request().Context(),
+			bson.D{{Key: "audon_id", Value: data.AudonID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "live_avatar", Value: false}}}})
+		if err == nil {
+			_, err = coll.UpdateOne(c.Request().Context(),
+				bson.D{
+					{Key: "audon_id", Value: data.AudonID},
+					{Key: "avatar_on_air", Value: bson.D{{Key: "$ne", Value: true}}},
+				},
+				bson.D{{Key: "$unset", Value: bson.D{{Key: "mastodon", Value: ""}, {Key: "software", Value: ""}}}})
+		}
+	}
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
 	err = writeSessionData(c, data)
 	if err != nil {
 		c.Logger().Error(err)
@@ -201,32 +224,47 @@ func getUserTokenHandler(c echo.Context) (err error) {
 	}
 
 	return c.JSON(http.StatusOK, &TokenResponse{
-		Url:   data.MastodonConfig.Server,
-		Token: data.MastodonConfig.AccessToken,
-		Audon: user,
+		Url:      data.MastodonConfig.Server,
+		Token:    data.MastodonConfig.AccessToken,
+		Audon:    user,
+		Software: normalizeSoftware(data.Software),
 	})
 }
 
 func logoutHandler(c echo.Context) (err error) {
 	data, err := getSessionData(c)
 	if err == nil && data.AudonID != "" {
-		mastoURL, err := url.Parse(data.MastodonConfig.Server)
-		if err != nil {
-			return ErrInvalidRequestFormat
-		}
-		mastoURL = mastoURL.JoinPath("oauth", "revoke")
-		formValues := url.Values{}
-		formValues.Add("client_id", data.MastodonConfig.ClientID)
-		formValues.Add("client_secret", data.MastodonConfig.ClientSecret)
-		formValues.Add("token", data.MastodonConfig.AccessToken)
-		request, err := http.NewRequest(http.MethodPost, mastoURL.String(), strings.NewReader(formValues.Encode()))
-		if err != nil {
-			c.Logger().Error(err)
-			return echo.NewHTTPError(http.StatusInternalServerError)
+		ctx := c.Request().Context()
+		// The stored copy of the token is still needed if the avatar cannot be restored now,
+		// e.g. the user is on air on another device, so it is revoked after the final restore.
+		restored := true
+		if user, err := findUserByID(ctx, data.AudonID); err == nil {
+			if still, err := user.InLivekit(ctx); err != nil || still {
+				restored = false
+			} else if err := user.RestoreAvatar(ctx); err != nil {
+				c.Logger().Warn(err)
+				restored = false
+			} else if err := user.ClearUserAvatar(ctx); err != nil {
+				c.Logger().Warn(err)
+			}
+		}
+		if restored {
+			// don't care even if revoking failed
+			if err := getProvider(data.Software).Revoke(ctx, data.MastodonConfig); err != nil {
+				c.Logger().Warn(err)
+			}
+			coll := mainDB.Collection(COLLECTION_USER)
+			if _, err := coll.UpdateOne(ctx,
+				bson.D{
+					{Key: "audon_id", Value: data.AudonID},
+					{Key: "mastodon.accesstoken", Value: data.MastodonConfig.AccessToken},
+				},
+				bson.D{{Key: "$unset", Value: bson.D{{Key: "mastodon", Value: ""}, {Key: "software", Value: ""}}}}); err != nil {
+				c.Logger().Error(err)
+			}
 		}
-		request.Header.Add("User-Agent", USER_AGENT)
-		http.DefaultClient.Do(request) // don't care even if revoking failed
-		writeSessionData(c, nil)       // to reset, write nil to user's session
+		userSessionCache.Delete(data.AudonID)
+		writeSessionData(c, nil) // to reset, write nil to user's session
 		return c.NoContent(http.StatusOK)
 	}
 
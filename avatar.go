@@ -11,6 +11,7 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"log"
 	"os"
 	"path/filepath"
 
@@ -92,6 +93,7 @@ func (u *AudonUser) GetIndicator(ctx context.Context, fnew []byte, room *Room) (
 		}); err != nil {
 		return
 	}
+	u.AvatarFile = filename
 
 	// indicator, err = u.createGIF(newImg, room.IsHost(u) || room.IsCoHost(u))
 	// if err != nil {
@@ -101,6 +103,106 @@ func (u *AudonUser) GetIndicator(ctx context.Context, fnew []byte, room *Room) (
 	return indicator, origImg, isGIF, nil
 }
 
+// Replaces the user's Mastodon avatar with the indicator generated from the stored original.
+// Blue indicator is used for host and cohosts.
+func (u *AudonUser) SetLiveAvatar(ctx context.Context, blue bool) error {
+	if u == nil || !u.LiveAvatar {
+		return nil
+	}
+	if u.AvatarFile == "" {
+		return errors.New("original avatar not stored")
+	}
+
+	orig, err := os.ReadFile(u.getAvatarImagePath(u.AvatarFile))
+	if err != nil {
+		return err
+	}
+	origImg, _, err := image.Decode(bytes.NewReader(orig))
+	if err != nil {
+		return err
+	}
+	if _, err := u.createGIF(origImg, blue); err != nil {
+		return err
+	}
+
+	mastoClient, err := u.GetMastodonClient(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := updateAvatar(ctx, mastoClient, u.getGIFAvatarPath()); err != nil {
+		return err
+	}
+
+	coll := mainDB.Collection(COLLECTION_USER)
+	_, err = coll.UpdateOne(ctx,
+		bson.D{{Key: "audon_id", Value: u.AudonID}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "avatar_on_air", Value: true}}},
+		})
+	return err
+}
+
+// Puts back the original avatar stored by GetIndicator if the indicator is currently set.
+func (u *AudonUser) RestoreAvatar(ctx context.Context) error {
+	if u == nil {
+		return nil
+	}
+
+	coll := mainDB.Collection(COLLECTION_USER)
+	count, err := coll.CountDocuments(ctx, bson.D{
+		{Key: "audon_id", Value: u.AudonID},
+		{Key: "avatar_on_air", Value: true},
+	})
+	if err != nil || count == 0 {
+		return err
+	}
+	if u.AvatarFile == "" {
+		return errors.New("original avatar not stored")
+	}
+
+	mastoClient, err := u.GetMastodonClient(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := updateAvatar(ctx, mastoClient, u.getAvatarImagePath(u.AvatarFile)); err != nil {
+		return err
+	}
+
+	_, err = coll.UpdateOne(ctx,
+		bson.D{{Key: "audon_id", Value: u.AudonID}},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "avatar_on_air", Value: false}}},
+		})
+	return err
+}
+
+// Restores avatars left as indicators, e.g. when the server was down while the user left.
+func restoreStaleAvatars(ctx context.Context) error {
+	coll := mainDB.Collection(COLLECTION_USER)
+	cur, err := coll.Find(ctx, bson.D{{Key: "avatar_on_air", Value: true}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var user AudonUser
+		if err := cur.Decode(&user); err != nil {
+			return err
+		}
+		if still, err := user.InLivekit(ctx); still || err != nil {
+			continue
+		}
+		if err := user.RestoreAvatar(ctx); err != nil {
+			log.Println(err)
+			continue
+		}
+		user.ClearUserAvatar(ctx)
+	}
+
+	return cur.Err()
+}
+
 func (u *AudonUser) createGIF(avatar image.Image, blue bool) ([]byte, error) {
 	avatarPNG := image.NewRGBA(image.Rect(0, 0, 150, 150))
 	draw.BiLinear.Scale(avatarPNG, avatarPNG.Rect, avatar, avatar.Bounds(), draw.Src, nil)
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaevor/go-nanoid"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/labstack/echo/v4"
+	mastodon "github.com/mattn/go-mastodon"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// An entry of the host's blocklist, applied to every room the host creates.
+	// Either Webfinger or Domain is set.
+	HostBan struct {
+		BanID     string    `bson:"ban_id" json:"ban_id"`
+		HostID    string    `bson:"host_id" json:"host_id"`
+		Webfinger string    `bson:"webfinger" json:"webfinger"`
+		Domain    string    `bson:"domain" json:"domain"`
+		AddedBy   string    `bson:"added_by" json:"added_by"`
+		RoomID    string    `bson:"room_id" json:"room_id"`
+		CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	}
+
+	// Accounts and domains blocked or muted by the host on Mastodon
+	HostBlockList struct {
+		Accounts map[string]bool
+		Domains  map[string]bool
+		// set if the lists have never been loaded, everyone except the host's team is denied
+		Unavailable bool
+	}
+
+	BanRequest struct {
+		Webfinger string `json:"webfinger" validate:"required_without=Domain,omitempty,email"`
+		Domain    string `json:"domain" validate:"required_without=Webfinger,omitempty,fqdn"`
+	}
+)
+
+// handler for GET to /api/ban
+func listBansHandler(c echo.Context) error {
+	host := c.Get("user").(*AudonUser)
+
+	coll := mainDB.Collection(COLLECTION_BAN)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cur, err := coll.Find(c.Request().Context(), bson.D{{Key: "host_id", Value: host.AudonID}}, opts)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	bans := []*HostBan{}
+	if err := cur.All(c.Request().Context(), &bans); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, bans)
+}
+
+// handler for POST to /api/ban
+func addBanHandler(c echo.Context) error {
+	req := new(BanRequest)
+	if err := c.Bind(req); err != nil {
+		return ErrInvalidRequestFormat
+	}
+	if err := mainValidator.Struct(req); err != nil {
+		return wrapValidationError(err)
+	}
+
+	host := c.Get("user").(*AudonUser)
+	ban := &HostBan{
+		HostID:    host.AudonID,
+		Webfinger: req.Webfinger,
+		Domain:    req.Domain,
+		AddedBy:   host.AudonID,
+	}
+	if ban.Webfinger != "" {
+		ban.Domain = ""
+	}
+	if err := insertBan(c.Request().Context(), ban); mongo.IsDuplicateKeyError(err) {
+		return echo.NewHTTPError(http.StatusConflict, "already_banned")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := insertModerationLog(c.Request().Context(), &ModerationLog{
+		HostID: host.AudonID,
+		Action: "add_ban",
+		Detail: ban.Domain,
+	}, host, &AudonUser{Webfinger: ban.Webfinger}); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.JSON(http.StatusCreated, ban)
+}
+
+// handler for DELETE to /api/ban/:id
+func removeBanHandler(c echo.Context) error {
+	banID := c.Param("id")
+	if err := mainValidator.Var(&banID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	host := c.Get("user").(*AudonUser)
+
+	coll := mainDB.Collection(COLLECTION_BAN)
+	result, err := coll.DeleteOne(c.Request().Context(), bson.D{
+		{Key: "ban_id", Value: banID},
+		{Key: "host_id", Value: host.AudonID},
+	})
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if result.DeletedCount == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "ban_not_found")
+	}
+	if err := insertModerationLog(c.Request().Context(), &ModerationLog{
+		HostID: host.AudonID,
+		Action: "remove_ban",
+		Detail: banID,
+	}, host, nil); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func insertBan(ctx context.Context, ban *HostBan) error {
+	canonic, err := nanoid.Standard(16)
+	if err != nil {
+		return err
+	}
+	ban.BanID = canonic()
+	ban.Webfinger = strings.ToLower(ban.Webfinger)
+	ban.Domain = strings.ToLower(ban.Domain)
+	ban.CreatedAt = time.Now().UTC()
+
+	coll := mainDB.Collection(COLLECTION_BAN)
+	_, err = coll.InsertOne(ctx, ban)
+	return err
+}
+
+// Returns true if the user or the user's domain is in the host's blocklist
+func (a *AudonUser) IsBannedBy(ctx context.Context, host *AudonUser) (bool, error) {
+	if a == nil || host == nil {
+		return false, nil
+	}
+
+	webfinger := strings.ToLower(a.Webfinger)
+	conditions := bson.A{bson.D{{Key: "webfinger", Value: webfinger}}}
+	if i := strings.LastIndex(webfinger, "@"); i >= 0 && i < len(webfinger)-1 {
+		conditions = append(conditions, bson.D{{Key: "domain", Value: webfinger[i+1:]}})
+	}
+
+	coll := mainDB.Collection(COLLECTION_BAN)
+	count, err := coll.CountDocuments(ctx, bson.D{
+		{Key: "host_id", Value: host.AudonID},
+		{Key: "$or", Value: conditions},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Returns true if the host keeps the user out of the room,
+// either by Audon's blocklist or by blocks and mutes on Mastodon if the room enables it.
+func isDeniedByHost(ctx context.Context, room *Room, user *AudonUser) (bool, error) {
+	if banned, err := user.IsBannedBy(ctx, room.Host); err != nil || banned {
+		return banned, err
+	}
+	if !room.DenyBlocked {
+		return false, nil
+	}
+
+	item := hostBlockCache.Get(room.Host.AudonID)
+	if item == nil {
+		return false, nil
+	}
+	blocks := item.Value()
+	if blocks.Unavailable {
+		return true, nil
+	}
+	webfinger := strings.ToLower(user.Webfinger)
+	if blocks.Accounts[webfinger] {
+		return true, nil
+	}
+	if i := strings.LastIndex(webfinger, "@"); i >= 0 && blocks.Domains[webfinger[i+1:]] {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Fetches the host's blocks, mutes and domain blocks with the stored token.
+// Called by hostBlockCache on a miss, so the lists are refreshed every time the cache expires.
+// If they cannot be fetched, the last lists loaded are kept, or everyone is denied if there are none.
+func loadHostBlockList(cache *ttlcache.Cache[string, *HostBlockList], hostID string) *ttlcache.Item[string, *HostBlockList] {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	blocks, err := fetchHostBlockList(ctx, hostID)
+	if err != nil {
+		log.Printf("failed to load the blocks of %s: %v\n", hostID, err)
+		// retry after a short while, not to request on every join
+		if item := hostBlockStaleCache.Get(hostID); item != nil {
+			return cache.Set(hostID, item.Value(), time.Minute)
+		}
+		return cache.Set(hostID, &HostBlockList{Unavailable: true}, time.Minute)
+	}
+	hostBlockStaleCache.Set(hostID, blocks, ttlcache.DefaultTTL)
+
+	return cache.Set(hostID, blocks, ttlcache.DefaultTTL)
+}
+
+func fetchHostBlockList(ctx context.Context, hostID string) (*HostBlockList, error) {
+	host := &AudonUser{AudonID: hostID}
+	mastoClient, err := host.GetMastodonClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := &HostBlockList{
+		Accounts: make(map[string]bool),
+		Domains:  make(map[string]bool),
+	}
+	for _, fetch := range []func(context.Context, *mastodon.Pagination) ([]*mastodon.Account, error){
+		mastoClient.GetBlocks,
+		mastoClient.GetMutes,
+	} {
+		pg := &mastodon.Pagination{Limit: 80}
+		for page := 0; page < 20; page++ {
+			prevMaxID := pg.MaxID
+			accounts, err := fetch(ctx, pg)
+			if err != nil {
+				return nil, err
+			}
+			for _, acc := range accounts {
+				blocks.Accounts[strings.ToLower(accountWebfinger(acc))] = true
+			}
+			// pg is left untouched if there is no Link header
+			if len(accounts) == 0 || pg.MaxID == "" || pg.MaxID == prevMaxID {
+				break
+			}
+			pg = &mastodon.Pagination{MaxID: pg.MaxID, Limit: 80}
+		}
+	}
+	domains, err := getDomainBlocks(ctx, mastoClient)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range domains {
+		blocks.Domains[strings.ToLower(d)] = true
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/livekit/protocol/livekit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// handler for POST to /api/room/:id/cohost
+// The user accepts the invitation to be a cohost.
+func acceptCoHostHandler(c echo.Context) error {
+	meta, live, err := getLiveOrStoredRoom(c)
+	if err != nil {
+		return err
+	}
+
+	user := c.Get("user").(*AudonUser)
+	if meta.IsCoHost(user) {
+		return echo.NewHTTPError(http.StatusConflict, "already_cohost")
+	}
+	if !meta.IsPendingCoHost(user) {
+		return ErrOperationNotPermitted
+	}
+
+	meta.PendingCoHosts = excludeUser(meta.PendingCoHosts, user)
+	meta.CoHosts = append(meta.CoHosts, user)
+	meta.Speakers = excludeUser(meta.Speakers, user)
+
+	if err := meta.storeCoHosts(c.Request().Context()); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := meta.logModeration(c.Request().Context(), user, "accept_cohost", user, ""); err != nil {
+		c.Logger().Error(err)
+	}
+	if !live {
+		return c.NoContent(http.StatusOK)
+	}
+	if err := updateRoomMetadata(c.Request().Context(), meta); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := meta.setCanPublish(c.Request().Context(), user, true); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if user.LiveAvatar {
+		go func(u *AudonUser, logger echo.Logger) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := u.SetLiveAvatar(ctx, true); err != nil {
+				logger.Error(err)
+			}
+		}(user, c.Logger())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// handler for DELETE to /api/room/:id/cohost
+// The user declines the invitation or leaves the cohost role.
+func leaveCoHostHandler(c echo.Context) error {
+	meta, live, err := getLiveOrStoredRoom(c)
+	if err != nil {
+		return err
+	}
+
+	user := c.Get("user").(*AudonUser)
+	wasCoHost := meta.IsCoHost(user)
+	if !wasCoHost && !meta.IsPendingCoHost(user) {
+		return ErrOperationNotPermitted
+	}
+
+	meta.PendingCoHosts = excludeUser(meta.PendingCoHosts, user)
+	meta.CoHosts = excludeUser(meta.CoHosts, user)
+
+	if err := meta.storeCoHosts(c.Request().Context()); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := meta.logModeration(c.Request().Context(), user, "leave_cohost", user, ""); err != nil {
+		c.Logger().Error(err)
+	}
+	if !live {
+		return c.NoContent(http.StatusOK)
+	}
+	if err := updateRoomMetadata(c.Request().Context(), meta); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if wasCoHost {
+		if err := meta.setCanPublish(c.Request().Context(), user, false); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if user.LiveAvatar {
+			go func(u *AudonUser, logger echo.Logger) {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				if err := u.RestoreAvatar(ctx); err != nil {
+					logger.Error(err)
+				}
+			}(user, c.Logger())
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// Returns the room in the path from LiveKit if it is live, otherwise from DB
+func getLiveOrStoredRoom(c echo.Context) (meta *RoomMetadata, live bool, err error) {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return nil, false, wrapValidationError(err)
+	}
+
+	if lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID); lkRoom != nil {
+		meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+		if err != nil {
+			c.Logger().Error(err)
+			return nil, false, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		return meta, true, nil
+	}
+
+	dbRoom, err := findRoomByID(c.Request().Context(), roomID)
+	if err != nil {
+		return nil, false, ErrRoomNotFound
+	}
+	if !dbRoom.EndedAt.IsZero() {
+		return nil, false, ErrAlreadyEnded
+	}
+	return &RoomMetadata{Room: dbRoom}, false, nil
+}
+
+// Stores cohosts and pending cohosts in DB. The caller should update the room metadata if live.
+func (r *Room) storeCoHosts(ctx context.Context) error {
+	if r.CoHosts == nil {
+		r.CoHosts = []*AudonUser{}
+	}
+	if r.PendingCoHosts == nil {
+		r.PendingCoHosts = []*AudonUser{}
+	}
+
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "room_id", Value: r.RoomID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "cohosts", Value: r.CoHosts},
+			{Key: "pending_cohosts", Value: r.PendingCoHosts},
+		}}})
+	return err
+}
+
+// Updates the publish permission of the user if the user is in the room
+func (r *RoomMetadata) setCanPublish(ctx context.Context, u *AudonUser, canPublish bool) error {
+	if !r.IsUserInLivekitRoom(ctx, u.AudonID) {
+		return nil
+	}
+	_, err := lkRoomServiceClient.UpdateParticipant(ctx, &livekit.UpdateParticipantRequest{
+		Room:     r.RoomID,
+		Identity: u.AudonID,
+		Permission: &livekit.ParticipantPermission{
+			CanPublishData: true,
+			CanSubscribe:   true,
+			CanPublish:     canPublish,
+		},
+	})
+	return err
+}
+
+// Applies the cohost list edited by the host. Users newly listed are invited and need to accept.
+// Returns the cohosts removed from the list.
+func (r *Room) applyCoHostList(ctx context.Context, list []*AudonUser) []*AudonUser {
+	resolveInvitees(ctx, list)
+
+	cohosts := []*AudonUser{}
+	pending := []*AudonUser{}
+	for _, u := range list {
+		if u == nil || r.IsHost(u) {
+			continue
+		}
+		if r.IsCoHost(u) {
+			cohosts = append(cohosts, u)
+		} else {
+			pending = append(pending, u)
+		}
+	}
+	removed := []*AudonUser{}
+	for _, u := range r.CoHosts {
+		if !containsUser(cohosts, u) {
+			removed = append(removed, u)
+		}
+	}
+	r.CoHosts = cohosts
+	r.PendingCoHosts = pending
+
+	return removed
+}
+
+// Takes the stage from cohosts removed while the room is live, as the demote operation does.
+// The caller updates the room metadata afterwards.
+func (r *RoomMetadata) dropCoHosts(ctx context.Context, removed []*AudonUser, logger echo.Logger) {
+	for _, u := range removed {
+		r.Speakers = excludeUser(r.Speakers, u)
+		if err := r.setCanPublish(ctx, u, false); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	go func(users []*AudonUser) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		for _, u := range users {
+			// the list only has the webfinger and the ID, the original avatar is in DB
+			user, err := findUserByID(ctx, u.AudonID)
+			if err != nil {
+				continue
+			}
+			if err := user.RestoreAvatar(ctx); err != nil {
+				logger.Error(err)
+			}
+		}
+	}(removed)
+}
+
+func containsUser(users []*AudonUser, u *AudonUser) bool {
+	for _, v := range users {
+		if v.Equal(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func excludeUser(users []*AudonUser, u *AudonUser) []*AudonUser {
+	result := make([]*AudonUser, 0, len(users))
+	for _, v := range users {
+		if !v.Equal(u) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
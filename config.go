@@ -1,12 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"image"
 	"image/png"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -20,6 +22,9 @@ type (
 		Database *DBConfig
 		Redis    *RedisConfig
 		Bot      *BotConfig
+		Guest    *GuestConfig
+		Limit    *RoomLimitConfig
+		Admins   []string // webfinger of the users who can see all moderation logs
 	}
 
 	AppConfigBase struct {
@@ -38,6 +43,10 @@ type (
 		LocalDomain      string `validate:"required,hostname|hostname_port"`
 		URL              *url.URL
 		EmptyRoomTimeout time.Duration `validate:"required"`
+		// Cohost is promoted to host after the host is absent for this period, 0 disables
+		HostSuccessionDelay time.Duration
+		// Host can resume the ended room within this period
+		ResumeGracePeriod time.Duration
 	}
 
 	DBConfig struct {
@@ -54,11 +63,37 @@ type (
 	}
 
 	BotConfig struct {
-		Enable       bool
-		Server       *url.URL
+		Enable bool // true if any bot account is set up
+		// Bot accounts, the room is announced by the one of the host's instance or of its language, or by Fallback
+		Accounts []*BotAccount
+		Fallback *BotAccount
+		// Mention admins in a direct message when a report is submitted
+		NotifyReports bool
+		// Defaults of the room announcements, templates are in localeBundle
+		Announcement *AnnouncementConfig
+	}
+
+	BotAccount struct {
+		Tag          string   `validate:"required,alphanum"`
+		Server       *url.URL `validate:"required"`
 		ClientID     string
 		ClientSecret string
-		AccessToken  string
+		AccessToken  string   `validate:"required,printascii"`
+		Languages    []string `validate:"dive,bcp47_language_tag"`
+		Instances    []string `validate:"dive,fqdn"` // domains of the hosts, prior to Languages
+	}
+
+	GuestConfig struct {
+		MaxPerRoom int `validate:"gte=0"`
+		RateLimit  int `validate:"gte=0"` // joins per IP address in RateWindow
+		RateWindow time.Duration
+	}
+
+	// Instance-wide caps on room capacity, 0 means unlimited
+	RoomLimitConfig struct {
+		MaxListeners int `validate:"gte=0"`
+		MaxSpeakers  int `validate:"gte=0"`
+		MaxDuration  time.Duration
 	}
 )
 
@@ -171,12 +206,22 @@ func loadConfig(envname string) (*AppConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	successionDelay, err := getEnvInt("LIVEKIT_HOST_SUCCESSION_DELAY", 5)
+	if err != nil {
+		return nil, err
+	}
+	resumeGrace, err := getEnvInt("LIVEKIT_RESUME_GRACE_PERIOD", 10)
+	if err != nil {
+		return nil, err
+	}
 	lkConf := &LivekitConfig{
-		APIKey:           os.Getenv("LIVEKIT_API_KEY"),
-		APISecret:        os.Getenv("LIVEKIT_API_SECRET"),
-		Host:             os.Getenv("LIVEKIT_HOST"),
-		LocalDomain:      os.Getenv("LIVEKIT_LOCAL_DOMAIN"),
-		EmptyRoomTimeout: time.Duration(timeout) * time.Second,
+		APIKey:              os.Getenv("LIVEKIT_API_KEY"),
+		APISecret:           os.Getenv("LIVEKIT_API_SECRET"),
+		Host:                os.Getenv("LIVEKIT_HOST"),
+		LocalDomain:         os.Getenv("LIVEKIT_LOCAL_DOMAIN"),
+		EmptyRoomTimeout:    time.Duration(timeout) * time.Second,
+		HostSuccessionDelay: time.Duration(successionDelay) * time.Minute,
+		ResumeGracePeriod:   time.Duration(resumeGrace) * time.Minute,
 	}
 	if err := mainValidator.Struct(lkConf); err != nil {
 		return nil, err
@@ -189,21 +234,179 @@ func loadConfig(envname string) (*AppConfig, error) {
 	appConf.Livekit = lkConf
 
 	// Setup Notification Bot config
-	botHost := os.Getenv("BOT_SERVER")
 	botConf := &BotConfig{
-		Enable:       botHost != "",
-		ClientID:     os.Getenv("BOT_CLIENT_ID"),
-		ClientSecret: os.Getenv("BOT_CLIENT_SECRET"),
-		AccessToken:  os.Getenv("BOT_ACCESS_TOKEN"),
-	}
-	if botConf.Enable {
-		botConf.Server = &url.URL{
-			Host:   botHost,
-			Scheme: "https",
-			Path:   "/",
+		NotifyReports: os.Getenv("BOT_NOTIFY_REPORTS") == "true",
+	}
+	// BOT_SERVER etc. set up the default bot, and BOTS lists tags of the others, e.g. BOT_JA_SERVER for "ja"
+	botTags := []string{""}
+	for _, tag := range strings.Split(os.Getenv("BOTS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			botTags = append(botTags, tag)
+		}
+	}
+	for _, tag := range botTags {
+		account, err := loadBotAccount(tag)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil {
+			continue
 		}
+		for _, other := range botConf.Accounts {
+			if strings.EqualFold(other.Tag, account.Tag) {
+				return nil, fmt.Errorf("duplicate bot: %s", account.Tag)
+			}
+			for _, lang := range account.Languages {
+				if other.servesLanguage(lang) {
+					return nil, fmt.Errorf("language %s is assigned to both bots %s and %s", lang, other.Tag, account.Tag)
+				}
+			}
+			for _, instance := range account.Instances {
+				if other.servesInstance(instance) {
+					return nil, fmt.Errorf("instance %s is assigned to both bots %s and %s", instance, other.Tag, account.Tag)
+				}
+			}
+		}
+		botConf.Accounts = append(botConf.Accounts, account)
+	}
+	if len(botConf.Accounts) > 0 {
+		botConf.Enable = true
+		// the default bot, or the first one if not set up
+		botConf.Fallback = botConf.Accounts[0]
+	}
+	followUp := os.Getenv("BOT_FOLLOW_UP") == "true"
+	announcement := &AnnouncementConfig{
+		SpoilerText: os.Getenv("BOT_SPOILER_TEXT"),
+		Visibility:  os.Getenv("BOT_VISIBILITY"),
+		Hashtags:    []string{},
+		FollowUp:    &followUp,
+	}
+	if announcement.Visibility == "" {
+		announcement.Visibility = "public"
+	}
+	hashtags, found := os.LookupEnv("BOT_HASHTAGS")
+	if !found {
+		hashtags = "Audon"
 	}
+	for _, tag := range strings.Split(hashtags, ",") {
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "#"); tag != "" {
+			announcement.Hashtags = append(announcement.Hashtags, tag)
+		}
+	}
+	if err := mainValidator.Struct(announcement); err != nil {
+		return nil, err
+	}
+	if _, err := executeAnnouncementTemplate(announcement.SpoilerText, &AnnouncementData{}); err != nil {
+		return nil, err
+	}
+	botConf.Announcement = announcement
 	appConf.Bot = botConf
 
+	// Setup guest listener config
+	guestMax, err := getEnvInt("GUEST_MAX_PER_ROOM", 50)
+	if err != nil {
+		return nil, err
+	}
+	guestRate, err := getEnvInt("GUEST_RATE_LIMIT", 5)
+	if err != nil {
+		return nil, err
+	}
+	guestConf := &GuestConfig{
+		MaxPerRoom: guestMax,
+		RateLimit:  guestRate,
+		RateWindow: 10 * time.Minute,
+	}
+	if err := mainValidator.Struct(guestConf); err != nil {
+		return nil, err
+	}
+	appConf.Guest = guestConf
+
+	// Setup room capacity config
+	maxListeners, err := getEnvInt("ROOM_MAX_LISTENERS", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxSpeakers, err := getEnvInt("ROOM_MAX_SPEAKERS", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxDuration, err := getEnvInt("ROOM_MAX_DURATION", 0)
+	if err != nil {
+		return nil, err
+	}
+	limitConf := &RoomLimitConfig{
+		MaxListeners: maxListeners,
+		MaxSpeakers:  maxSpeakers,
+		MaxDuration:  time.Duration(maxDuration) * time.Minute,
+	}
+	if err := mainValidator.Struct(limitConf); err != nil {
+		return nil, err
+	}
+	appConf.Limit = limitConf
+
+	// Setup admin accounts
+	for _, admin := range strings.Split(os.Getenv("ADMIN_ACCOUNTS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			appConf.Admins = append(appConf.Admins, admin)
+		}
+	}
+
 	return &appConf, nil
 }
+
+// Loads BOT_SERVER etc. if tag is empty, otherwise BOT_<TAG>_SERVER etc.
+// Returns nil if the server is not set.
+func loadBotAccount(tag string) (*BotAccount, error) {
+	prefix := "BOT_"
+	if tag != "" {
+		prefix = fmt.Sprintf("BOT_%s_", strings.ToUpper(tag))
+	}
+	host := os.Getenv(prefix + "SERVER")
+	if host == "" {
+		if tag != "" {
+			return nil, fmt.Errorf("%sSERVER is required for the bot in BOTS", prefix)
+		}
+		return nil, nil
+	}
+
+	account := &BotAccount{
+		Tag: strings.ToLower(tag),
+		Server: &url.URL{
+			Host:   host,
+			Scheme: "https",
+			Path:   "/",
+		},
+		ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		AccessToken:  os.Getenv(prefix + "ACCESS_TOKEN"),
+		Languages:    []string{},
+		Instances:    []string{},
+	}
+	if tag == "" {
+		account.Tag = "default"
+	}
+	for _, lang := range strings.Split(os.Getenv(prefix+"LANGUAGES"), ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			account.Languages = append(account.Languages, lang)
+		}
+	}
+	for _, instance := range strings.Split(os.Getenv(prefix+"INSTANCES"), ",") {
+		if instance = strings.TrimSpace(instance); instance != "" {
+			account.Instances = append(account.Instances, strings.ToLower(instance))
+		}
+	}
+	if err := mainValidator.Struct(account); err != nil {
+		return nil, fmt.Errorf("invalid config of the bot %s: %w", account.Tag, err)
+	}
+
+	return account, nil
+}
+
+// Returns the integer value of the environment variable, or defaultValue if it is not set
+func getEnvInt(name string, defaultValue int) (int, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(val)
+}
@@ -15,8 +15,33 @@ var (
 	ErrOperationNotPermitted = echo.NewHTTPError(http.StatusForbidden, "operation_not_permitted")
 	ErrUserNotFound          = echo.NewHTTPError(http.StatusNotFound, "user_not_found")
 	ErrAlreadyEnded          = echo.NewHTTPError(http.StatusGone, "already_ended")
+	ErrRoomResumable         = echo.NewHTTPError(http.StatusGone, "resumable")
+	ErrAccountUnavailable    = echo.NewHTTPError(http.StatusForbidden, "account_unavailable")
+	ErrBannedByHost          = echo.NewHTTPError(http.StatusForbidden, "banned")
+	ErrInvalidInvite         = echo.NewHTTPError(http.StatusForbidden, "invalid_invite")
+	ErrInviteNotFound        = echo.NewHTTPError(http.StatusNotFound, "invite_not_found")
+	ErrGuestNotAllowed       = echo.NewHTTPError(http.StatusForbidden, "guest_not_allowed")
+	ErrTooManyRequests       = echo.NewHTTPError(http.StatusTooManyRequests, "too_many_requests")
+	ErrRoomFull              = echo.NewHTTPError(http.StatusConflict, "room_full")
+	ErrSpeakersFull          = echo.NewHTTPError(http.StatusConflict, "speakers_full")
+	ErrJoinFiltered          = echo.NewHTTPError(http.StatusForbidden, "account_filtered")
+	ErrListUnavailable       = echo.NewHTTPError(http.StatusForbidden, "list_unavailable")
+	ErrInvalidTemplate       = echo.NewHTTPError(http.StatusBadRequest, "invalid_template")
+	// the host's token is not available to fetch the blocks or the list, the host needs to log in again
+	ErrCredentialUnavailable = echo.NewHTTPError(http.StatusForbidden, "credential_unavailable")
+	// the host's account was not found or the instance didn't respond, unlike RestrictionError
+	ErrRelationshipUnverifiable = echo.NewHTTPError(http.StatusForbidden, "relationship_unverifiable")
 )
 
+// Returned when a user doesn't satisfy the join restriction of a room
+type RestrictionError struct {
+	Restriction JoinRestriction
+}
+
+func (e *RestrictionError) Error() string {
+	return string(e.Restriction)
+}
+
 func wrapValidationError(err error) error {
 	wrapped := errors.Wrap(err, "validation_failed")
 	return echo.NewHTTPError(http.StatusBadRequest, wrapped.Error())
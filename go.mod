@@ -20,6 +20,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/rbcervilla/redisstore/v9 v9.0.0-rc1
 	github.com/sizeofint/webpanimation v0.0.0-20210809145948-1d2b32119882
+	github.com/twitchtv/twirp v8.1.2+incompatible
 	go.mongodb.org/mongo-driver v1.11.0
 	golang.org/x/image v0.3.0
 	golang.org/x/text v0.6.0
@@ -83,7 +84,6 @@ require (
 	github.com/prometheus/procfs v0.8.0 // indirect
 	github.com/thoas/go-funk v0.9.2 // indirect
 	github.com/tomnomnom/linkheader v0.0.0-20180905144013-02ca5825eb80 // indirect
-	github.com/twitchtv/twirp v8.1.2+incompatible // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.1 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
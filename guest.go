@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaevor/go-nanoid"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/livekit/protocol/auth"
+	"github.com/livekit/protocol/livekit"
+)
+
+// Metadata of a guest listener without a Fediverse account,
+// set to the LiveKit participant so that clients can label guests.
+type GuestUser struct {
+	AudonID     string `json:"audon_id"`
+	DisplayName string `json:"display_name"`
+	Guest       bool   `json:"guest"`
+}
+
+const (
+	GUEST_ID_PREFIX = "guest_"
+	// Guests refresh the token with the key returned on joining, the key expires if not used in this period
+	GUEST_KEY_TTL = 2 * ROOM_TOKEN_TTL
+)
+
+type GuestRefreshRequest struct {
+	GuestKey string `json:"guest_key" validate:"required,printascii"`
+}
+
+// handler for POST to /app/room/:id/guest, this bypasses authentication
+func guestJoinHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	room, err := findRoomByID(c.Request().Context(), roomID)
+	if err != nil {
+		return ErrRoomNotFound
+	}
+	if !room.EndedAt.IsZero() && room.EndedAt.Before(time.Now()) {
+		return ErrAlreadyEnded
+	}
+
+	lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID)
+	if lkRoom == nil {
+		return ErrRoomNotFound
+	}
+	roomMetadata, err := getRoomMetadataFromLivekitRoom(lkRoom)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	// use the live settings since the host may have changed them.
+	// guests can neither wait in the lobby nor be checked by the join filter, so they are kept out of such rooms
+	if !roomMetadata.AllowsGuests() || roomMetadata.Lobby || roomMetadata.EffectiveJoinFilter() != nil {
+		return ErrGuestNotAllowed
+	}
+
+	// rate limit per IP address in a fixed window
+	ip := c.RealIP()
+	count := 0
+	ttl := ttlcache.DefaultTTL
+	if item := guestRateCache.Get(ip); item != nil {
+		count = item.Value()
+		ttl = time.Until(item.ExpiresAt())
+	}
+	if count >= mainConfig.Guest.RateLimit {
+		return ErrTooManyRequests
+	}
+	guestRateCache.Set(ip, count+1, ttl)
+
+	if countGuestsInRoom(c.Request().Context(), roomID) >= mainConfig.Guest.MaxPerRoom {
+		return ErrRoomFull
+	}
+	if limit := roomMetadata.ListenerLimit(); limit > 0 {
+		count, err := roomMetadata.CountListeners(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if count >= limit {
+			return ErrRoomFull
+		}
+	}
+
+	canonic, err := nanoid.Standard(16)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	id := canonic()
+	guest := &GuestUser{
+		AudonID:     GUEST_ID_PREFIX + id,
+		DisplayName: fmt.Sprintf("Guest %s", id[:4]),
+		Guest:       true,
+	}
+
+	token, err := getGuestRoomToken(room, guest)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	keygen, err := nanoid.Standard(32)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	guestKey := keygen()
+	guestKeyCache.Set(guestKeyCacheKey(roomID, guestKey), guest, ttlcache.DefaultTTL)
+
+	return c.JSON(http.StatusOK, &TokenResponse{
+		Url:      mainConfig.Livekit.URL.String(),
+		Token:    token,
+		Guest:    guest,
+		GuestKey: guestKey,
+	})
+}
+
+// handler for POST to /app/room/:id/guest/refresh, this bypasses authentication
+func refreshGuestTokenHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+	req := new(GuestRefreshRequest)
+	if err := c.Bind(req); err != nil {
+		return ErrInvalidRequestFormat
+	}
+	if err := mainValidator.Struct(req); err != nil {
+		return wrapValidationError(err)
+	}
+
+	item := guestKeyCache.Get(guestKeyCacheKey(roomID, req.GuestKey))
+	if item == nil {
+		return ErrGuestNotAllowed
+	}
+	guest := item.Value()
+
+	room, err := findRoomByID(c.Request().Context(), roomID)
+	if err != nil {
+		return ErrRoomNotFound
+	}
+	if !room.EndedAt.IsZero() && room.EndedAt.Before(time.Now()) {
+		return ErrAlreadyEnded
+	}
+	lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID)
+	if lkRoom == nil {
+		return ErrRoomNotFound
+	}
+	roomMetadata, err := getRoomMetadataFromLivekitRoom(lkRoom)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	// guests already in the room may stay after the lobby or raid mode is turned on, but not after kicked
+	if !roomMetadata.AllowsGuests() || roomMetadata.IsGuestKicked(guest.AudonID) {
+		guestKeyCache.Delete(guestKeyCacheKey(roomID, req.GuestKey))
+		return ErrGuestNotAllowed
+	}
+
+	token, err := getGuestRoomToken(room, guest)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, &TokenResponse{
+		Url:   mainConfig.Livekit.URL.String(),
+		Token: token,
+		Guest: guest,
+	})
+}
+
+func guestKeyCacheKey(roomID, guestKey string) string {
+	return roomID + "/" + guestKey
+}
+
+// Returns true if the room accepts guests, whether or not the room is full
+func (r *RoomMetadata) AllowsGuests() bool {
+	return mainConfig.Guest.MaxPerRoom > 0 && r.AllowGuests && r.Restriction == EVERYONE
+}
+
+// Guests are compared only by identity since they don't have webfingers
+func (r *RoomMetadata) IsGuestKicked(identity string) bool {
+	for _, k := range r.Kicked {
+		if k.AudonID == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// Guests can only listen, neither speak nor send data such as chats and emojis
+func getGuestRoomToken(room *Room, guest *GuestUser) (string, error) {
+	at := auth.NewAccessToken(mainConfig.Livekit.APIKey, mainConfig.Livekit.APISecret)
+	canPublish := false
+	canPublishData := false
+	grant := &auth.VideoGrant{
+		Room:           room.RoomID,
+		RoomJoin:       true,
+		RoomCreate:     false,
+		CanPublish:     &canPublish,
+		CanPublishData: &canPublishData,
+	}
+	metadata, _ := json.Marshal(guest)
+
+	at.AddGrant(grant).SetIdentity(guest.AudonID).SetName(guest.DisplayName).SetValidFor(ROOM_TOKEN_TTL).SetMetadata(string(metadata))
+
+	return at.ToJWT()
+}
+
+func countGuestsInRoom(ctx context.Context, roomID string) int {
+	participantsInfo, _ := lkRoomServiceClient.ListParticipants(ctx, &livekit.ListParticipantsRequest{Room: roomID})
+
+	count := 0
+	for _, p := range participantsInfo.GetParticipants() {
+		if isGuestIdentity(p.GetIdentity()) {
+			count++
+		}
+	}
+	return count
+}
+
+func isGuestIdentity(identity string) bool {
+	return strings.HasPrefix(identity, GUEST_ID_PREFIX)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Hands the room over to the new host, and the former host stays as a cohost.
+// The host and the cohosts are stored and the room metadata is updated together,
+// so that the former host is never left in both places.
+func (r *RoomMetadata) transferHost(ctx context.Context, newHost *AudonUser) error {
+	formerHost := r.Host
+	r.CoHosts = append(excludeUser(excludeUser(r.CoHosts, newHost), formerHost), formerHost)
+	r.PendingCoHosts = excludeUser(excludeUser(r.PendingCoHosts, newHost), formerHost)
+	r.Speakers = excludeUser(excludeUser(r.Speakers, newHost), formerHost)
+	r.Host = newHost
+
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	if _, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "room_id", Value: r.RoomID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "host", Value: r.Host},
+			{Key: "cohosts", Value: r.CoHosts},
+			{Key: "pending_cohosts", Value: r.PendingCoHosts},
+			{Key: "succession_at", Value: time.Time{}},
+		}}}); err != nil {
+		return err
+	}
+	return updateRoomMetadata(ctx, r)
+}
+
+// Promotes the longest-present cohost if the host does not come back within the delay.
+// The due time is kept in DB and checked by the room scheduler, so the succession survives a restart.
+func scheduleHostSuccession(ctx context.Context, roomID, hostID string) error {
+	delay := mainConfig.Livekit.HostSuccessionDelay
+	if delay <= 0 {
+		return nil
+	}
+
+	// the succession already scheduled is kept
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "room_id", Value: roomID},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "succession_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+				bson.D{{Key: "succession_at", Value: time.Time{}}},
+			}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "succession_at", Value: time.Now().UTC().Add(delay)},
+			{Key: "succession_from", Value: hostID},
+		}}})
+	return err
+}
+
+func cancelHostSuccession(ctx context.Context, roomID string) error {
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "room_id", Value: roomID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "succession_at", Value: time.Time{}}}}})
+	return err
+}
+
+// Runs the successions which are due, called by the room scheduler
+func processHostSuccessions(ctx context.Context) error {
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	cur, err := coll.Find(ctx, bson.D{
+		{Key: "ended_at", Value: time.Time{}},
+		{Key: "succession_at", Value: bson.D{
+			{Key: "$gt", Value: time.Time{}},
+			{Key: "$lte", Value: time.Now().UTC()},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	var rooms []*Room
+	if err := cur.All(ctx, &rooms); err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		// claimed first so that only one server runs each succession
+		result, err := coll.UpdateOne(ctx,
+			bson.D{
+				{Key: "room_id", Value: room.RoomID},
+				{Key: "succession_at", Value: room.SuccessionAt},
+			},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "succession_at", Value: time.Time{}}}}})
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+		if err := succeedHost(ctx, room.RoomID, room.SuccessionFrom); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+func succeedHost(ctx context.Context, roomID, formerHostID string) error {
+	lkRoom, _ := getRoomInLivekit(ctx, roomID)
+	if lkRoom == nil {
+		return nil
+	}
+	meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+	if err != nil {
+		return err
+	}
+	// the host has been changed or has come back in the meantime
+	if meta.Host == nil || meta.Host.AudonID != formerHostID {
+		return nil
+	}
+
+	participantsInfo, err := lkRoomServiceClient.ListParticipants(ctx, &livekit.ListParticipantsRequest{Room: roomID})
+	if err != nil {
+		return err
+	}
+	var successor *AudonUser
+	var joinedAt int64
+	for _, p := range participantsInfo.GetParticipants() {
+		if p.GetIdentity() == formerHostID {
+			return nil
+		}
+		for _, cohost := range meta.CoHosts {
+			if cohost.AudonID == p.GetIdentity() && (successor == nil || p.GetJoinedAt() < joinedAt) {
+				successor = cohost
+				joinedAt = p.GetJoinedAt()
+			}
+		}
+	}
+	// no cohost is in the room, try again when a cohost joins
+	if successor == nil {
+		return nil
+	}
+
+	if err := meta.transferHost(ctx, successor); err != nil {
+		return err
+	}
+	if err := meta.logModeration(ctx, nil, "succession", successor, ""); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
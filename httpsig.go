@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Signs and verifies requests with HTTP Signatures (draft-cavage-http-signatures) as most Fediverse software does.
+// Only rsa-sha256 is supported.
+
+var SIGNED_HEADERS = []string{"(request-target)", "host", "date", "digest"}
+
+// Incoming requests older than this are rejected to prevent replaying
+const SIGNATURE_MAX_AGE = 12 * time.Hour
+
+func signRequest(req *http.Request, body []byte, keyID string, key *rsa.PrivateKey) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := SIGNED_HEADERS
+	if body != nil {
+		req.Header.Set("Digest", bodyDigest(body))
+	} else {
+		headers = headers[:3]
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// Parses the Signature header into its parameters, the caller looks up the key of keyId
+func parseSignatureHeader(req *http.Request) (map[string]string, error) {
+	header := req.Header.Get("Signature")
+	if header == "" {
+		return nil, errors.New("signature not found")
+	}
+
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		params[key] = strings.Trim(value, `"`)
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, errors.New("invalid signature header")
+	}
+	if params["headers"] == "" {
+		params["headers"] = "date"
+	}
+
+	return params, nil
+}
+
+func verifySignature(req *http.Request, body []byte, params map[string]string, publicKeyPem string) error {
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	signed := func(name string) bool {
+		for _, h := range headers {
+			if h == name {
+				return true
+			}
+		}
+		return false
+	}
+	// the target and the host must be signed, otherwise a signed request to another server could be replayed here
+	if !signed("(request-target)") || !signed("host") || !signed("date") || (body != nil && !signed("digest")) {
+		return errors.New("required headers not signed")
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return err
+	}
+	if age := time.Since(date); age > SIGNATURE_MAX_AGE || age < -SIGNATURE_MAX_AGE {
+		return errors.New("signature expired")
+	}
+	if body != nil && req.Header.Get("Digest") != bodyDigest(body) {
+		return errors.New("digest mismatch")
+	}
+
+	publicKey, err := parsePublicKey(publicKeyPem)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], sig)
+}
+
+func signingString(req *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI()))
+		case "host":
+			host := req.Host
+			if host == "" {
+				host = req.URL.Host
+			}
+			lines = append(lines, "host: "+host)
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %s", h, req.Header.Get(h)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func generateKeyPair() (privatePem string, publicPem string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	privatePem = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	publicPem = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	return privatePem, publicPem, nil
+}
+
+func parsePrivateKey(privatePem string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privatePem))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func parsePublicKey(publicPem string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicPem))
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	// some software still publishes PKCS #1 keys
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an rsa key")
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	privatePem, publicPem, err := generateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parsePrivateKey(privatePem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPublicPem, err := generateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"type":"Follow"}`)
+	tests := []struct {
+		name      string
+		body      []byte
+		publicPem string
+		// changes the request after signing it, as an attacker or a broken proxy would
+		tamper   func(req *http.Request) []byte
+		wantErr  bool
+		parseErr bool
+	}{
+		{name: "post with body", body: body, publicPem: publicPem},
+		{name: "get without body", publicPem: publicPem},
+		{name: "key of another actor", body: body, publicPem: otherPublicPem, wantErr: true},
+		{
+			name: "body replaced", body: body, publicPem: publicPem, wantErr: true,
+			tamper: func(req *http.Request) []byte { return []byte(`{"type":"Delete"}`) },
+		},
+		{
+			name: "body and digest replaced", body: body, publicPem: publicPem, wantErr: true,
+			tamper: func(req *http.Request) []byte {
+				other := []byte(`{"type":"Delete"}`)
+				req.Header.Set("Digest", bodyDigest(other))
+				return other
+			},
+		},
+		{
+			name: "sent to another path", body: body, publicPem: publicPem, wantErr: true,
+			tamper: func(req *http.Request) []byte {
+				req.URL.Path = "/ap/users/other/inbox"
+				return body
+			},
+		},
+		{
+			name: "sent to another host", body: body, publicPem: publicPem, wantErr: true,
+			tamper: func(req *http.Request) []byte {
+				req.Host = "other.example.com"
+				return body
+			},
+		},
+		{
+			name: "date too old", body: body, publicPem: publicPem, wantErr: true,
+			tamper: func(req *http.Request) []byte {
+				req.Header.Set("Date", time.Now().Add(-SIGNATURE_MAX_AGE-time.Minute).UTC().Format(http.TimeFormat))
+				return body
+			},
+		},
+		{
+			name: "date not signed", body: body, publicPem: publicPem, wantErr: true,
+			tamper: func(req *http.Request) []byte {
+				sig := req.Header.Get("Signature")
+				req.Header.Set("Signature", strings.Replace(sig, `headers="(request-target) host date digest"`, `headers="(request-target) host digest"`, 1))
+				return body
+			},
+		},
+		{
+			name: "no signature", body: body, publicPem: publicPem, parseErr: true,
+			tamper: func(req *http.Request) []byte {
+				req.Header.Del("Signature")
+				return body
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := http.MethodGet
+			if tt.body != nil {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "https://audon.example.com/ap/users/host/inbox", nil)
+			if err := signRequest(req, tt.body, "https://remote.example.com/users/alice#main-key", key); err != nil {
+				t.Fatal(err)
+			}
+			received := tt.body
+			if tt.tamper != nil {
+				received = tt.tamper(req)
+			}
+
+			params, err := parseSignatureHeader(req)
+			if tt.parseErr {
+				if err == nil {
+					t.Error("parseSignatureHeader() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params["keyId"] != "https://remote.example.com/users/alice#main-key" {
+				t.Errorf("keyId = %q", params["keyId"])
+			}
+			err = verifySignature(req, received, params, tt.publicPem)
+			if tt.wantErr && err == nil {
+				t.Error("verifySignature() succeeded, want an error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("verifySignature() = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jaevor/go-nanoid"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	Invite struct {
+		InviteID   string            `bson:"invite_id" json:"invite_id"`
+		RoomID     string            `bson:"room_id" json:"room_id"`
+		Role       string            `bson:"role" json:"role"`
+		CreatedBy  string            `bson:"created_by" json:"created_by"`
+		Revoked    bool              `bson:"revoked" json:"revoked"`
+		RedeemedBy []*InviteRedeemer `bson:"redeemed_by" json:"redeemed_by"`
+		ExpiresAt  time.Time         `bson:"expires_at" json:"expires_at"`
+		CreatedAt  time.Time         `bson:"created_at" json:"created_at"`
+	}
+
+	InviteRedeemer struct {
+		AudonID    string    `bson:"audon_id" json:"audon_id"`
+		Webfinger  string    `bson:"webfinger" json:"webfinger"`
+		RedeemedAt time.Time `bson:"redeemed_at" json:"redeemed_at"`
+	}
+
+	InviteRequest struct {
+		Role      string `json:"role" validate:"required,oneof=listener speaker"`
+		ExpiresIn int64  `json:"expires_in" validate:"gte=0"` // seconds
+	}
+
+	InviteResponse struct {
+		*Invite
+		Token string `json:"token"`
+		URL   string `json:"url"`
+	}
+)
+
+const (
+	INVITE_DEFAULT_TTL = 24 * time.Hour
+	INVITE_MAX_TTL     = 7 * 24 * time.Hour
+)
+
+// handler for POST to /api/room/:id/invite
+func createInviteHandler(c echo.Context) error {
+	room, err := getRoomForModeration(c)
+	if err != nil {
+		return err
+	}
+
+	req := new(InviteRequest)
+	if err := c.Bind(req); err != nil {
+		return ErrInvalidRequestFormat
+	}
+	if err := mainValidator.Struct(req); err != nil {
+		return wrapValidationError(err)
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl <= 0 {
+		ttl = INVITE_DEFAULT_TTL
+	} else if ttl > INVITE_MAX_TTL {
+		ttl = INVITE_MAX_TTL
+	}
+
+	canonic, err := nanoid.Standard(16)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	now := time.Now().UTC()
+	invite := &Invite{
+		InviteID:   canonic(),
+		RoomID:     room.RoomID,
+		Role:       req.Role,
+		CreatedBy:  c.Get("user").(*AudonUser).AudonID,
+		RedeemedBy: []*InviteRedeemer{},
+		ExpiresAt:  now.Add(ttl),
+		CreatedAt:  now,
+	}
+
+	coll := mainDB.Collection(COLLECTION_INVITE)
+	if _, err := coll.InsertOne(c.Request().Context(), invite); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := room.logModeration(c.Request().Context(), c.Get("user").(*AudonUser), "create_invite", nil, invite.InviteID); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.JSON(http.StatusCreated, invite.response())
+}
+
+// handler for GET to /api/room/:id/invite
+func listInvitesHandler(c echo.Context) error {
+	room, err := getRoomForModeration(c)
+	if err != nil {
+		return err
+	}
+
+	coll := mainDB.Collection(COLLECTION_INVITE)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cur, err := coll.Find(c.Request().Context(), bson.D{{Key: "room_id", Value: room.RoomID}}, opts)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	invites := []*Invite{}
+	if err := cur.All(c.Request().Context(), &invites); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	resp := make([]*InviteResponse, 0, len(invites))
+	for _, v := range invites {
+		resp = append(resp, v.response())
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handler for DELETE to /api/room/:id/invite/:invite
+func revokeInviteHandler(c echo.Context) error {
+	room, err := getRoomForModeration(c)
+	if err != nil {
+		return err
+	}
+
+	inviteID := c.Param("invite")
+	if err := mainValidator.Var(&inviteID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	coll := mainDB.Collection(COLLECTION_INVITE)
+	result, err := coll.UpdateOne(c.Request().Context(),
+		bson.D{{Key: "invite_id", Value: inviteID}, {Key: "room_id", Value: room.RoomID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "revoked", Value: true}}}})
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if result.MatchedCount == 0 {
+		return ErrInviteNotFound
+	}
+	if err := room.logModeration(c.Request().Context(), c.Get("user").(*AudonUser), "revoke_invite", nil, inviteID); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// Returns the room in the path if the user is its host or cohost
+func getRoomForModeration(c echo.Context) (*RoomMetadata, error) {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return nil, wrapValidationError(err)
+	}
+
+	var room *RoomMetadata
+	if lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID); lkRoom != nil {
+		meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+		if err != nil {
+			c.Logger().Error(err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		room = meta
+	} else {
+		dbRoom, err := findRoomByID(c.Request().Context(), roomID)
+		if err != nil {
+			return nil, ErrRoomNotFound
+		}
+		room = &RoomMetadata{Room: dbRoom}
+	}
+
+	user := c.Get("user").(*AudonUser)
+	if !room.IsHost(user) && !room.IsCoHost(user) {
+		return nil, ErrOperationNotPermitted
+	}
+
+	return room, nil
+}
+
+// Verifies the invite token for the room. The invite is not redeemed yet.
+func findValidInvite(ctx context.Context, token, roomID string) (*Invite, error) {
+	inviteID, _, found := strings.Cut(token, ".")
+	if !found {
+		return nil, ErrInvalidInvite
+	}
+
+	var invite Invite
+	coll := mainDB.Collection(COLLECTION_INVITE)
+	if err := coll.FindOne(ctx, bson.D{{Key: "invite_id", Value: inviteID}}).Decode(&invite); err != nil {
+		return nil, ErrInvalidInvite
+	}
+	if !hmac.Equal([]byte(token), []byte(invite.token())) || invite.RoomID != roomID {
+		return nil, ErrInvalidInvite
+	}
+	if invite.Revoked || invite.ExpiresAt.Before(time.Now()) {
+		return nil, ErrInvalidInvite
+	}
+
+	return &invite, nil
+}
+
+// Records the user as a redeemer, the caller should check the user is not banned nor kicked beforehand
+func (i *Invite) redeem(ctx context.Context, user *AudonUser) error {
+	coll := mainDB.Collection(COLLECTION_INVITE)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "invite_id", Value: i.InviteID}, {Key: "redeemed_by.audon_id", Value: bson.D{{Key: "$ne", Value: user.AudonID}}}},
+		bson.D{{Key: "$push", Value: bson.D{{Key: "redeemed_by", Value: &InviteRedeemer{
+			AudonID:    user.AudonID,
+			Webfinger:  user.Webfinger,
+			RedeemedAt: time.Now().UTC(),
+		}}}}})
+	return err
+}
+
+// Returns true if the user has redeemed an invite of the room which is not revoked
+func (a *AudonUser) HasRedeemedInvite(ctx context.Context, roomID string) (bool, error) {
+	coll := mainDB.Collection(COLLECTION_INVITE)
+	count, err := coll.CountDocuments(ctx, bson.D{
+		{Key: "room_id", Value: roomID},
+		{Key: "revoked", Value: false},
+		{Key: "redeemed_by.audon_id", Value: a.AudonID},
+	})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Token is the invite ID signed with a key derived from the LiveKit API secret,
+// so that invite IDs cannot be guessed from links of other rooms.
+func (i *Invite) token() string {
+	key := sha256.Sum256([]byte("audon-invite:" + mainConfig.Livekit.APISecret))
+	mac := hmac.New(sha256.New, key[:])
+	fmt.Fprintf(mac, "%s|%s|%s|%d", i.InviteID, i.RoomID, i.Role, i.ExpiresAt.Unix())
+	return fmt.Sprintf("%s.%s", i.InviteID, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (i *Invite) response() *InviteResponse {
+	token := i.token()
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     mainConfig.LocalDomain,
+		Path:     fmt.Sprintf("/r/%s", i.RoomID),
+		RawQuery: url.Values{"invite": {token}}.Encode(),
+	}
+	return &InviteResponse{Invite: i, Token: token, URL: u.String()}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/labstack/echo/v4"
+	mastodon "github.com/mattn/go-mastodon"
+)
+
+// Accounts in the host's Mastodon list, keyed by lowercased webfinger
+type HostListMembers map[string]bool
+
+// handler for GET to /api/lists
+// Returns the Mastodon lists of the user in the session to choose from when creating a room.
+func getMastodonListsHandler(c echo.Context) error {
+	data, _ := getSessionData(c)
+	mastoClient := getMastodonClient(data)
+	if mastoClient == nil {
+		return ErrListUnavailable
+	}
+
+	lists, err := mastoClient.GetLists(c.Request().Context())
+	if err != nil {
+		// tokens issued before read:lists was requested fail here
+		c.Logger().Warn(err)
+		return ErrListUnavailable
+	}
+
+	return c.JSON(http.StatusOK, lists)
+}
+
+// Checks that the list in the request belongs to the user in the session
+func checkRoomList(c echo.Context, restriction JoinRestriction, listID string) error {
+	if restriction != LIST {
+		return nil
+	}
+	if listID == "" {
+		return ErrInvalidRequestFormat
+	}
+
+	data, _ := getSessionData(c)
+	mastoClient := getMastodonClient(data)
+	if mastoClient == nil {
+		return ErrListUnavailable
+	}
+	if _, err := mastoClient.GetList(c.Request().Context(), mastodon.ID(listID)); err != nil {
+		c.Logger().Warn(err)
+		return ErrListUnavailable
+	}
+
+	return nil
+}
+
+// Returns true if the user is in the list of the room
+func isInRoomList(room *Room, user *AudonUser) bool {
+	if room.ListID == "" || user == nil {
+		return false
+	}
+	item := hostListCache.Get(room.Host.AudonID + "/" + room.ListID)
+	if item == nil {
+		return false
+	}
+	return item.Value()[strings.ToLower(user.Webfinger)]
+}
+
+// Fetches the accounts in the host's list with the stored token.
+// Called by hostListCache on a miss, the key is the host's AudonID and the list ID joined with a slash.
+func loadHostListMembers(cache *ttlcache.Cache[string, HostListMembers], key string) *ttlcache.Item[string, HostListMembers] {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// cache an empty list for a short while if the list is not available,
+	// e.g. the host's token lacks read:lists, not to request on every join
+	emptyMembers := HostListMembers{}
+
+	hostID, listID, found := strings.Cut(key, "/")
+	if !found {
+		return cache.Set(key, emptyMembers, time.Minute)
+	}
+
+	host := &AudonUser{AudonID: hostID}
+	mastoClient, err := host.GetMastodonClient(ctx)
+	if err != nil {
+		log.Println(err)
+		return cache.Set(key, emptyMembers, time.Minute)
+	}
+
+	accounts, err := getListAccounts(ctx, mastoClient, listID)
+	if err != nil {
+		log.Println(err)
+		return cache.Set(key, emptyMembers, time.Minute)
+	}
+	members := HostListMembers{}
+	for _, acc := range accounts {
+		members[strings.ToLower(accountWebfinger(acc))] = true
+	}
+
+	return cache.Set(key, members, ttlcache.DefaultTTL)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type LobbyStatus struct {
+	Status string `json:"status"`
+}
+
+const (
+	LOBBY_PENDING  = "pending"
+	LOBBY_ADMITTED = "admitted"
+	LOBBY_DENIED   = "denied"
+
+	LOBBY_POLL_TIMEOUT  = 25 * time.Second
+	LOBBY_POLL_INTERVAL = 2 * time.Second
+)
+
+// Puts the user in the pending queue of the room and notifies host and cohosts.
+// The caller should update the room metadata.
+func (r *RoomMetadata) addToLobby(ctx context.Context, u *AudonUser) error {
+	if r.IsPending(u) {
+		return nil
+	}
+	r.Pending = append(r.Pending, u)
+
+	ids := []string{r.Host.AudonID}
+	for _, cohost := range r.CoHosts {
+		ids = append(ids, cohost.AudonID)
+	}
+	return sendRoomData(ctx, r.RoomID, M{"kind": "lobby_request", "audon_id": u.AudonID}, ids...)
+}
+
+// handler for GET to /api/room/:id/lobby
+// Long-polls until the user in the lobby is admitted or denied, or the timeout.
+func waitLobbyHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	user := c.Get("user").(*AudonUser)
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), LOBBY_POLL_TIMEOUT)
+	defer cancel()
+	ticker := time.NewTicker(LOBBY_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		lkRoom, _ := getRoomInLivekit(ctx, roomID)
+		if lkRoom == nil {
+			return ErrRoomNotFound
+		}
+		meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+
+		if meta.IsAdmitted(user) {
+			return c.JSON(http.StatusOK, &LobbyStatus{Status: LOBBY_ADMITTED})
+		} else if meta.IsKicked(user) {
+			return c.JSON(http.StatusOK, &LobbyStatus{Status: LOBBY_DENIED})
+		} else if !meta.IsPending(user) {
+			return ErrUserNotFound
+		}
+
+		select {
+		case <-ctx.Done():
+			return c.JSON(http.StatusOK, &LobbyStatus{Status: LOBBY_PENDING})
+		case <-ticker.C:
+		}
+	}
+}
+
+// handler for PUT to /api/room/:id/lobby, intended to be called by host or cohost
+func updateLobbyHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID)
+	if lkRoom == nil {
+		return ErrRoomNotFound
+	}
+	meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	iam := c.Get("user").(*AudonUser)
+	if !meta.IsHost(iam) && !meta.IsCoHost(iam) {
+		return ErrOperationNotPermitted
+	}
+
+	params := make(map[string]string)
+	if err := c.Bind(&params); err != nil {
+		return ErrInvalidRequestFormat
+	}
+	operation := params["op"]
+
+	var tgtUser *AudonUser
+	pending := make([]*AudonUser, 0, len(meta.Pending))
+	for _, p := range meta.Pending {
+		if p.AudonID == params["identity"] {
+			tgtUser = p
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	if tgtUser == nil {
+		return ErrUserNotFound
+	}
+
+	if operation == "admit" {
+		meta.Admitted = append(meta.Admitted, tgtUser)
+	} else if operation == "deny" {
+		meta.Kicked = append(meta.Kicked, tgtUser)
+	} else {
+		return ErrInvalidRequestFormat
+	}
+	meta.Pending = pending
+
+	if err := updateRoomMetadata(c.Request().Context(), meta); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := meta.logModeration(c.Request().Context(), iam, operation, tgtUser, ""); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
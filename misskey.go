@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jaevor/go-nanoid"
+	mastodon "github.com/mattn/go-mastodon"
+)
+
+// Logs in with MiAuth, which needs no app registration.
+// The MiAuth session is kept in SessionData.AuthCode until the user comes back.
+type misskeyProvider struct{}
+
+type misskeyUser struct {
+	ID             string    `json:"id"`
+	Username       string    `json:"username"`
+	Host           string    `json:"host"` // empty for local users
+	Name           string    `json:"name"`
+	AvatarURL      string    `json:"avatarUrl"`
+	URL            string    `json:"url"` // set only for remote users
+	URI            string    `json:"uri"`
+	CreatedAt      time.Time `json:"createdAt"`
+	FollowersCount int64     `json:"followersCount"`
+	FollowingCount int64     `json:"followingCount"`
+	NotesCount     int64     `json:"notesCount"`
+	IsBot          bool      `json:"isBot"`
+	IsFollowing    bool      `json:"isFollowing"`
+	IsFollowed     bool      `json:"isFollowed"`
+	IsBlocking     bool      `json:"isBlocking"`
+	IsMuted        bool      `json:"isMuted"`
+}
+
+const MIAUTH_PERMISSIONS = "read:account,read:following,read:blocks,read:mutes"
+
+func (p *misskeyProvider) Authorize(ctx context.Context, data *SessionData, state string) (string, error) {
+	canonic, err := nanoid.Standard(21)
+	if err != nil {
+		return "", err
+	}
+	data.AuthCode = canonic()
+
+	callback := &url.URL{
+		Host:     mainConfig.LocalDomain,
+		Scheme:   "https",
+		Path:     "/app/oauth",
+		RawQuery: url.Values{"state": {state}}.Encode(),
+	}
+	u, err := url.Parse(data.MastodonConfig.Server)
+	if err != nil {
+		return "", err
+	}
+	u = u.JoinPath("miauth", data.AuthCode)
+	u.RawQuery = url.Values{
+		"name":       {"Audon"},
+		"callback":   {callback.String()},
+		"permission": {MIAUTH_PERMISSIONS},
+	}.Encode()
+
+	return u.String(), nil
+}
+
+func (p *misskeyProvider) Authenticate(ctx context.Context, data *SessionData, req *OAuthRequest) error {
+	if req.Session == "" || req.Session != data.AuthCode {
+		return errors.New("miauth session mismatch")
+	}
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Token string `json:"token"`
+	}
+	if err := misskeyAPI(ctx, data.MastodonConfig.Server, "miauth/"+req.Session+"/check", nil, &result); err != nil {
+		return err
+	}
+	if !result.OK || result.Token == "" {
+		return errors.New("miauth not authorized")
+	}
+	data.MastodonConfig.AccessToken = result.Token
+
+	return nil
+}
+
+func (p *misskeyProvider) GetCurrentAccount(ctx context.Context, conf *mastodon.Config) (*mastodon.Account, error) {
+	var user misskeyUser
+	if err := misskeyAPI(ctx, conf.Server, "i", map[string]interface{}{"i": conf.AccessToken}, &user); err != nil {
+		return nil, err
+	}
+	return user.toAccount(conf.Server), nil
+}
+
+// Looks up the target by the username and host, then resolves the account URL if not found
+func (p *misskeyProvider) GetRelationship(ctx context.Context, conf *mastodon.Config, target *AudonUser) (*mastodon.Relationship, error) {
+	username, host, found := strings.Cut(target.Webfinger, "@")
+	if !found {
+		return nil, fmt.Errorf("invalid webfinger: %s", target.Webfinger)
+	}
+	if server, err := url.Parse(conf.Server); err == nil && strings.EqualFold(server.Host, host) {
+		host = ""
+	}
+
+	var user misskeyUser
+	params := map[string]interface{}{"i": conf.AccessToken, "username": username}
+	if host != "" {
+		params["host"] = host
+	}
+	err := misskeyAPI(ctx, conf.Server, "users/show", params, &user)
+	if err != nil || !isSameAccountURL(user.toAccount(conf.Server).URL, target.RemoteURL) {
+		var resolved struct {
+			Type   string      `json:"type"`
+			Object misskeyUser `json:"object"`
+		}
+		if err := misskeyAPI(ctx, conf.Server, "ap/show", map[string]interface{}{
+			"i":   conf.AccessToken,
+			"uri": target.RemoteURL,
+		}, &resolved); err != nil {
+			return nil, err
+		}
+		if resolved.Type != "User" {
+			return nil, fmt.Errorf("%w: %s", errAccountNotResolved, target.Webfinger)
+		}
+		user = resolved.Object
+	}
+
+	return &mastodon.Relationship{
+		ID:         mastodon.ID(user.ID),
+		Following:  user.IsFollowing,
+		FollowedBy: user.IsFollowed,
+		Blocking:   user.IsBlocking,
+		Muting:     user.IsMuted,
+	}, nil
+}
+
+// MiAuth tokens are revoked by the user in the settings of Misskey
+func (p *misskeyProvider) Revoke(ctx context.Context, conf *mastodon.Config) error {
+	return nil
+}
+
+func (u *misskeyUser) toAccount(server string) *mastodon.Account {
+	profileURL := u.URL
+	if profileURL == "" {
+		if base, err := url.Parse(server); err == nil {
+			profileURL = base.JoinPath("@" + u.Username).String()
+		}
+	}
+	acct := u.Username
+	if u.Host != "" {
+		acct += "@" + u.Host
+	}
+
+	return &mastodon.Account{
+		ID:             mastodon.ID(u.ID),
+		Username:       u.Username,
+		Acct:           acct,
+		DisplayName:    u.Name,
+		Avatar:         u.AvatarURL,
+		AvatarStatic:   u.AvatarURL,
+		URL:            profileURL,
+		CreatedAt:      u.CreatedAt,
+		FollowersCount: u.FollowersCount,
+		FollowingCount: u.FollowingCount,
+		StatusesCount:  u.NotesCount,
+		Bot:            u.IsBot,
+	}
+}
+
+// Calls the endpoint of Misskey API, which accepts only POST with JSON
+func misskeyAPI(ctx context.Context, server, endpoint string, params map[string]interface{}, v interface{}) error {
+	u, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath("api", endpoint)
+
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", USER_AGENT)
+	resp, err := apHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
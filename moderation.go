@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaevor/go-nanoid"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// An entry of the moderation log. Entries are only inserted, never updated or deleted.
+type ModerationLog struct {
+	LogID     string    `bson:"log_id" json:"log_id"`
+	RoomID    string    `bson:"room_id" json:"room_id"`
+	HostID    string    `bson:"host_id" json:"host_id"`
+	ActorID   string    `bson:"actor_id" json:"actor_id"` // empty if done by the server
+	Actor     string    `bson:"actor" json:"actor"`
+	TargetID  string    `bson:"target_id" json:"target_id"`
+	Target    string    `bson:"target" json:"target"`
+	Action    string    `bson:"action" json:"action"`
+	Detail    string    `bson:"detail" json:"detail"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+const (
+	MODERATION_LOG_DEFAULT_LIMIT = 100
+	MODERATION_LOG_MAX_LIMIT     = 500
+)
+
+// handler for GET to /api/room/:id/log, for host and cohosts of the room and admins
+func listRoomModerationLogHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	user := c.Get("user").(*AudonUser)
+	if !user.IsAdmin() {
+		if _, err := getRoomForModeration(c); err != nil {
+			return err
+		}
+	}
+
+	return findModerationLogs(c, bson.D{{Key: "room_id", Value: roomID}})
+}
+
+// handler for GET to /api/log, for admins only
+func listModerationLogHandler(c echo.Context) error {
+	user := c.Get("user").(*AudonUser)
+	if !user.IsAdmin() {
+		return ErrOperationNotPermitted
+	}
+
+	filter := bson.D{}
+	for _, key := range []string{"host_id", "actor_id", "target_id", "action"} {
+		if v := c.QueryParam(key); v != "" {
+			filter = append(filter, bson.E{Key: key, Value: v})
+		}
+	}
+
+	return findModerationLogs(c, filter)
+}
+
+// Responds with logs newest first. Older logs can be paged with the "before" query in RFC 3339.
+func findModerationLogs(c echo.Context, filter bson.D) error {
+	limit := MODERATION_LOG_DEFAULT_LIMIT
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return ErrInvalidRequestFormat
+		}
+		if n < MODERATION_LOG_MAX_LIMIT {
+			limit = n
+		} else {
+			limit = MODERATION_LOG_MAX_LIMIT
+		}
+	}
+	if v := c.QueryParam("before"); v != "" {
+		before, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return ErrInvalidRequestFormat
+		}
+		filter = append(filter, bson.E{Key: "created_at", Value: bson.D{{Key: "$lt", Value: before}}})
+	}
+
+	coll := mainDB.Collection(COLLECTION_MODERATION_LOG)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit))
+	cur, err := coll.Find(c.Request().Context(), filter, opts)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	logs := []*ModerationLog{}
+	if err := cur.All(c.Request().Context(), &logs); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, logs)
+}
+
+// Appends an entry to the moderation log of the room. Actor is nil if done by the server.
+func (r *Room) logModeration(ctx context.Context, actor *AudonUser, action string, target *AudonUser, detail string) error {
+	entry := &ModerationLog{
+		RoomID: r.RoomID,
+		Action: action,
+		Detail: detail,
+	}
+	if r.Host != nil {
+		entry.HostID = r.Host.AudonID
+	}
+	return insertModerationLog(ctx, entry, actor, target)
+}
+
+func insertModerationLog(ctx context.Context, entry *ModerationLog, actor, target *AudonUser) error {
+	canonic, err := nanoid.Standard(16)
+	if err != nil {
+		return err
+	}
+	entry.LogID = canonic()
+	if actor != nil {
+		entry.ActorID = actor.AudonID
+		entry.Actor = actor.Webfinger
+	}
+	if target != nil {
+		entry.TargetID = target.AudonID
+		entry.Target = target.Webfinger
+	}
+	entry.CreatedAt = time.Now().UTC()
+
+	coll := mainDB.Collection(COLLECTION_MODERATION_LOG)
+	_, err = coll.InsertOne(ctx, entry)
+	return err
+}
+
+func (a *AudonUser) IsAdmin() bool {
+	if a == nil {
+		return false
+	}
+	for _, admin := range mainConfig.Admins {
+		if strings.EqualFold(admin, a.Webfinger) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/livekit/protocol/livekit"
+)
+
+// handler for PUT to /api/room/:id/mute
+// Mutes microphones of all speakers at once. Cohosts are muted only by the host.
+func muteAllHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID)
+	if lkRoom == nil {
+		return ErrRoomNotFound
+	}
+	meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	iam := c.Get("user").(*AudonUser)
+	if !meta.IsHost(iam) && !meta.IsCoHost(iam) {
+		return ErrOperationNotPermitted
+	}
+
+	targets := meta.Speakers
+	if meta.IsHost(iam) {
+		targets = append(excludeUser(meta.CoHosts, iam), targets...)
+	}
+	for _, u := range targets {
+		muted, err := muteMicrophone(c.Request().Context(), roomID, u.AudonID)
+		if err != nil {
+			c.Logger().Error(err)
+			continue
+		}
+		if muted {
+			meta.recordMute(u, iam)
+		}
+	}
+
+	if err := updateRoomMetadata(c.Request().Context(), meta); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := meta.logModeration(c.Request().Context(), iam, "mute_all", nil, ""); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// Mutes the microphone track of the participant without taking away the permission to speak.
+// Returns false if there is no unmuted microphone.
+func muteMicrophone(ctx context.Context, roomID, identity string) (bool, error) {
+	info, err := lkRoomServiceClient.GetParticipant(ctx, &livekit.RoomParticipantIdentity{
+		Room:     roomID,
+		Identity: identity,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	muted := false
+	for _, track := range info.GetTracks() {
+		if track.GetSource() != livekit.TrackSource_MICROPHONE || track.GetMuted() {
+			continue
+		}
+		if _, err := lkRoomServiceClient.MutePublishedTrack(ctx, &livekit.MuteRoomTrackRequest{
+			Room:     roomID,
+			Identity: identity,
+			TrackSid: track.GetSid(),
+			Muted:    true,
+		}); err != nil {
+			return muted, err
+		}
+		muted = true
+	}
+
+	return muted, nil
+}
+
+// Records who muted the user. The caller should update the room metadata.
+func (r *RoomMetadata) recordMute(u, by *AudonUser) {
+	if r.MutedBy == nil {
+		r.MutedBy = make(map[string]string)
+	}
+	r.MutedBy[u.AudonID] = by.AudonID
+}
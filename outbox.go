@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	mastodon "github.com/mattn/go-mastodon"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Posts of the bot are queued in DB and sent by runOutbox, so that they survive failures of the bot's server and restarts.
+// Each post has a key unique to the room and the event, thus retried webhooks don't post twice.
+// Activities delivered to the inboxes of followers are queued in the same way.
+
+type (
+	OutboxKind  string
+	OutboxState string
+
+	OutboxPost struct {
+		Key           string      `bson:"key"`
+		RoomID        string      `bson:"room_id"`
+		Kind          OutboxKind  `bson:"kind"`
+		Bot           string      `bson:"bot"` // tag of the bot account, the fallback if empty
+		State         OutboxState `bson:"state"`
+		Status        string      `bson:"status"`
+		SpoilerText   string      `bson:"spoiler_text"`
+		Language      string      `bson:"language"`
+		Visibility    string      `bson:"visibility"`
+		InReplyToID   string      `bson:"in_reply_to_id"`
+		ParentKey     string      `bson:"parent_key"` // replies to this post, sent after it
+		StatusID      string      `bson:"status_id"`  // set after sent
+		Attempts      int         `bson:"attempts"`
+		LastError     string      `bson:"last_error"`
+		NextAttemptAt time.Time   `bson:"next_attempt_at"`
+		CreatedAt     time.Time   `bson:"created_at"`
+		SentAt        time.Time   `bson:"sent_at"`
+		// only for activities
+		Sender   string `bson:"sender"` // audon_id of the local actor
+		Inbox    string `bson:"inbox"`
+		Activity string `bson:"activity"` // JSON
+	}
+
+	idempotencyKey struct{}
+
+	// Sets Idempotency-Key so that Mastodon ignores a post sent again after the response was lost
+	idempotencyTransport struct {
+		base http.RoundTripper
+	}
+)
+
+const (
+	OUTBOX_ANNOUNCEMENT OutboxKind = "announcement"
+	OUTBOX_FOLLOW_UP    OutboxKind = "follow_up"
+	OUTBOX_SUBSCRIPTION OutboxKind = "subscription"
+	OUTBOX_REPORT       OutboxKind = "report"
+	OUTBOX_ACTIVITY     OutboxKind = "activity"
+
+	OUTBOX_PENDING OutboxState = "pending"
+	OUTBOX_SENT    OutboxState = "sent"
+	OUTBOX_FAILED  OutboxState = "failed"
+
+	OUTBOX_INTERVAL = 5 * time.Second
+	// Interval between posts, not to hit the rate limit of the bot's server
+	OUTBOX_POST_INTERVAL = 2 * time.Second
+	// Other workers don't take the post being sent in this period
+	OUTBOX_LEASE = 2 * time.Minute
+	// Waits 30s, 1m, 2m, ... before retrying, gives up after OUTBOX_MAX_ATTEMPTS
+	OUTBOX_RETRY_BASE   = 30 * time.Second
+	OUTBOX_MAX_ATTEMPTS = 8
+)
+
+var (
+	errBotNotFound  = errors.New("bot not found in the config")
+	errParentFailed = errors.New("parent post failed")
+)
+
+// Returns the key of the post, e.g. "<room_id>/announcement/<started_at>"
+func outboxKey(roomID string, kind OutboxKind, elem ...any) string {
+	parts := []string{roomID, string(kind)}
+	for _, e := range elem {
+		parts = append(parts, fmt.Sprint(e))
+	}
+	return strings.Join(parts, "/")
+}
+
+// Queues the post of the bot or the activity. Posts with the same key are queued only once.
+func enqueueBotPost(ctx context.Context, post *OutboxPost) error {
+	now := time.Now().UTC()
+	post.State = OUTBOX_PENDING
+	post.NextAttemptAt = now
+	post.CreatedAt = now
+
+	coll := mainDB.Collection(COLLECTION_OUTBOX)
+	if _, err := coll.InsertOne(ctx, post); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	return nil
+}
+
+// Sends queued posts until ctx is canceled
+func runOutbox(ctx context.Context) {
+	ticker := time.NewTicker(OUTBOX_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := processOutbox(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func processOutbox(ctx context.Context) error {
+	for {
+		post, err := claimOutboxPost(ctx)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if post.Kind == OUTBOX_ACTIVITY {
+			// inboxes are on different servers, no need to wait
+			if err := sendOutboxActivity(ctx, post); err != nil {
+				log.Printf("Failed delivering %s: %s\n", post.Key, err.Error())
+			}
+			continue
+		}
+		if err := sendOutboxPost(ctx, post); err != nil {
+			log.Printf("Failed sending %s: %s\n", post.Key, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(OUTBOX_POST_INTERVAL):
+		}
+	}
+}
+
+// Takes the oldest post due, leasing it not to be sent by others in the meantime
+func claimOutboxPost(ctx context.Context) (*OutboxPost, error) {
+	now := time.Now().UTC()
+	coll := mainDB.Collection(COLLECTION_OUTBOX)
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	filter := bson.D{
+		{Key: "state", Value: OUTBOX_PENDING},
+		{Key: "next_attempt_at", Value: bson.D{{Key: "$lte", Value: now}}},
+	}
+	// posts of the bot wait until the bot is enabled again
+	if !mainConfig.Bot.Enable {
+		filter = append(filter, bson.E{Key: "kind", Value: OUTBOX_ACTIVITY})
+	}
+
+	var post OutboxPost
+	if err := coll.FindOneAndUpdate(ctx,
+		filter,
+		bson.D{{Key: "$set", Value: bson.D{{Key: "next_attempt_at", Value: now.Add(OUTBOX_LEASE)}}}},
+		opts,
+	).Decode(&post); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+func sendOutboxPost(ctx context.Context, post *OutboxPost) error {
+	coll := mainDB.Collection(COLLECTION_OUTBOX)
+	filter := bson.D{{Key: "key", Value: post.Key}}
+
+	if post.ParentKey != "" && post.InReplyToID == "" {
+		var parent OutboxPost
+		if err := coll.FindOne(ctx, bson.D{{Key: "key", Value: post.ParentKey}}).Decode(&parent); err != nil {
+			return err
+		}
+		if parent.State == OUTBOX_FAILED {
+			_, err := coll.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{
+				{Key: "state", Value: OUTBOX_FAILED},
+				{Key: "last_error", Value: errParentFailed.Error()},
+			}}})
+			if err != nil {
+				return err
+			}
+			return errParentFailed
+		}
+		if parent.StatusID == "" {
+			// wait for the parent without counting attempts
+			_, err := coll.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{
+				{Key: "next_attempt_at", Value: parent.NextAttemptAt.Add(OUTBOX_INTERVAL)},
+			}}})
+			return err
+		}
+		// only the bot of the parent can reply to it
+		post.InReplyToID = parent.StatusID
+		post.Bot = parent.Bot
+	}
+
+	account := mainConfig.Bot.AccountByTag(post.Bot)
+	// replies are sent only by the bot of the status, except ones queued before multiple bots were supported
+	if account == nil && (post.InReplyToID == "" || post.Bot == "") {
+		account = mainConfig.Bot.Fallback
+	}
+	if account == nil {
+		_, err := coll.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "state", Value: OUTBOX_FAILED},
+			{Key: "last_error", Value: errBotNotFound.Error()},
+		}}})
+		if err != nil {
+			return err
+		}
+		return errBotNotFound
+	}
+
+	status, err := newBotClient(account).PostStatus(context.WithValue(ctx, idempotencyKey{}, post.Key), &mastodon.Toot{
+		Status:      post.Status,
+		SpoilerText: post.SpoilerText,
+		Language:    post.Language,
+		Visibility:  post.Visibility,
+		InReplyToID: mastodon.ID(post.InReplyToID),
+	})
+	if err != nil {
+		retryOutboxPost(post, err)
+		return err
+	}
+
+	if _, err := coll.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "state", Value: OUTBOX_SENT},
+		{Key: "attempts", Value: post.Attempts + 1},
+		{Key: "status_id", Value: string(status.ID)},
+		{Key: "sent_at", Value: time.Now().UTC()},
+	}}}); err != nil {
+		return err
+	}
+
+	if post.Kind == OUTBOX_ANNOUNCEMENT {
+		// remembered for the follow-up reply and later edits
+		collRoom := mainDB.Collection(COLLECTION_ROOM)
+		if _, err := collRoom.UpdateOne(ctx,
+			bson.D{{Key: "room_id", Value: post.RoomID}},
+			bson.D{{Key: "$set", Value: bson.D{
+				{Key: "announcement_id", Value: string(status.ID)},
+				{Key: "announcement_bot", Value: account.Tag},
+			}}},
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sendOutboxActivity(ctx context.Context, post *OutboxPost) error {
+	coll := mainDB.Collection(COLLECTION_OUTBOX)
+	filter := bson.D{{Key: "key", Value: post.Key}}
+
+	sender, err := findUserByID(ctx, post.Sender)
+	if err != nil {
+		retryOutboxPost(post, err)
+		return err
+	}
+	if err := deliverActivity(ctx, sender, post.Inbox, json.RawMessage(post.Activity)); err != nil {
+		retryOutboxPost(post, err)
+		return err
+	}
+
+	_, err = coll.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "state", Value: OUTBOX_SENT},
+		{Key: "attempts", Value: post.Attempts + 1},
+		{Key: "sent_at", Value: time.Now().UTC()},
+	}}})
+	return err
+}
+
+// Schedules the next attempt of the failed post with backoff, or gives up after OUTBOX_MAX_ATTEMPTS
+func retryOutboxPost(post *OutboxPost, cause error) {
+	attempts, state, backoff := nextOutboxAttempt(post.Attempts)
+	// use a new context, the post must not stay leased after the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coll := mainDB.Collection(COLLECTION_OUTBOX)
+	if _, err := coll.UpdateOne(ctx, bson.D{{Key: "key", Value: post.Key}}, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "state", Value: state},
+		{Key: "attempts", Value: attempts},
+		{Key: "last_error", Value: cause.Error()},
+		{Key: "next_attempt_at", Value: time.Now().UTC().Add(backoff)},
+	}}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns the attempts counted with the failed one, the next state and the wait before the next attempt
+func nextOutboxAttempt(attempts int) (int, OutboxState, time.Duration) {
+	state := OUTBOX_PENDING
+	if attempts+1 >= OUTBOX_MAX_ATTEMPTS {
+		state = OUTBOX_FAILED
+	}
+	return attempts + 1, state, OUTBOX_RETRY_BASE * time.Duration(1<<attempts)
+}
+
+func (t *idempotencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if key, ok := req.Context().Value(idempotencyKey{}).(string); ok && req.Method == http.MethodPost {
+		req = req.Clone(req.Context())
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return t.base.RoundTrip(req)
+}
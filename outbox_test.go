@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextOutboxAttempt(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     int
+		wantAttempts int
+		wantState    OutboxState
+		wantBackoff  time.Duration
+	}{
+		{"first failure", 0, 1, OUTBOX_PENDING, 30 * time.Second},
+		{"second failure", 1, 2, OUTBOX_PENDING, time.Minute},
+		{"third failure", 2, 3, OUTBOX_PENDING, 2 * time.Minute},
+		{"one before the last", OUTBOX_MAX_ATTEMPTS - 2, OUTBOX_MAX_ATTEMPTS - 1, OUTBOX_PENDING, OUTBOX_RETRY_BASE << (OUTBOX_MAX_ATTEMPTS - 2)},
+		{"last attempt", OUTBOX_MAX_ATTEMPTS - 1, OUTBOX_MAX_ATTEMPTS, OUTBOX_FAILED, OUTBOX_RETRY_BASE << (OUTBOX_MAX_ATTEMPTS - 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts, state, backoff := nextOutboxAttempt(tt.attempts)
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if state != tt.wantState {
+				t.Errorf("state = %s, want %s", state, tt.wantState)
+			}
+			if backoff != tt.wantBackoff {
+				t.Errorf("backoff = %s, want %s", backoff, tt.wantBackoff)
+			}
+		})
+	}
+}
+
+func TestOutboxKey(t *testing.T) {
+	tests := []struct {
+		name string
+		elem []any
+		want string
+	}{
+		{"room only", nil, "room1/announcement"},
+		{"with start time", []any{int64(1700000000)}, "room1/announcement/1700000000"},
+		{"with inbox", []any{int64(1), "https://example.com/inbox"}, "room1/announcement/1/https://example.com/inbox"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outboxKey("room1", OUTBOX_ANNOUNCEMENT, tt.elem...); got != tt.want {
+				t.Errorf("outboxKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	mastodon "github.com/mattn/go-mastodon"
+)
+
+// Fediverse server software users log in from.
+// Accounts and relationships are converted into Mastodon entities, so that the rest of Audon doesn't depend on the software.
+type FediverseProvider interface {
+	// Registers Audon on the server if needed and returns the URL to let the user authorize it.
+	// data.MastodonConfig.Server is set by the caller.
+	Authorize(ctx context.Context, data *SessionData, state string) (string, error)
+	// Obtains the access token after the user is redirected back to /app/oauth
+	Authenticate(ctx context.Context, data *SessionData, req *OAuthRequest) error
+	GetCurrentAccount(ctx context.Context, conf *mastodon.Config) (*mastodon.Account, error)
+	// Returns the relationship between the user of the token and the target, seen from the user's server
+	GetRelationship(ctx context.Context, conf *mastodon.Config, target *AudonUser) (*mastodon.Relationship, error)
+	Revoke(ctx context.Context, conf *mastodon.Config) error
+}
+
+const (
+	SOFTWARE_MASTODON = "mastodon"
+	SOFTWARE_MISSKEY  = "misskey"
+)
+
+var providers = map[string]FediverseProvider{
+	SOFTWARE_MASTODON: &mastodonProvider{},
+	SOFTWARE_MISSKEY:  &misskeyProvider{},
+}
+
+// Forks of Misskey which support MiAuth. Other software is regarded as compatible with Mastodon API.
+var misskeyFamily = []string{"misskey", "firefish", "calckey", "sharkey", "foundkey", "cherrypick", "iceshrimp", "meisskey"}
+
+// Sessions and credentials stored before the software was recorded are Mastodon
+func normalizeSoftware(software string) string {
+	if _, ok := providers[software]; ok {
+		return software
+	}
+	return SOFTWARE_MASTODON
+}
+
+func getProvider(software string) FediverseProvider {
+	return providers[normalizeSoftware(software)]
+}
+
+// Detects the software of the server with NodeInfo
+func detectSoftware(ctx context.Context, server *url.URL) (string, error) {
+	var links struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := getJSON(ctx, server.JoinPath(".well-known", "nodeinfo").String(), &links); err != nil {
+		return "", err
+	}
+
+	href := ""
+	for _, l := range links.Links {
+		if strings.HasPrefix(l.Rel, "http://nodeinfo.diaspora.software/ns/schema/2.") {
+			href = l.Href
+		}
+	}
+	if href == "" {
+		return "", errors.New("nodeinfo not found")
+	}
+
+	var nodeinfo struct {
+		Software struct {
+			Name string `json:"name"`
+		} `json:"software"`
+	}
+	if err := getJSON(ctx, href, &nodeinfo); err != nil {
+		return "", err
+	}
+
+	name := strings.ToLower(nodeinfo.Software.Name)
+	for _, fork := range misskeyFamily {
+		if name == fork {
+			return SOFTWARE_MISSKEY, nil
+		}
+	}
+	return SOFTWARE_MASTODON, nil
+}
+
+func getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", USER_AGENT)
+	resp, err := apHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type mastodonProvider struct{}
+
+func (p *mastodonProvider) Authorize(ctx context.Context, data *SessionData, state string) (string, error) {
+	appConfig, err := getAppConfig(data.MastodonConfig.Server, data.LiveAvatar)
+	if err != nil {
+		return "", err
+	}
+	mastApp, err := registerApp(ctx, appConfig)
+	if err != nil {
+		return "", err
+	}
+	data.MastodonConfig.ClientID = mastApp.ClientID
+	data.MastodonConfig.ClientSecret = mastApp.ClientSecret
+
+	redirURL, err := url.Parse(mastApp.AuthURI)
+	if err != nil {
+		return "", err
+	}
+	q := redirURL.Query()
+	q.Add("state", state)
+	redirURL.RawQuery = q.Encode()
+
+	return redirURL.String(), nil
+}
+
+func (p *mastodonProvider) Authenticate(ctx context.Context, data *SessionData, req *OAuthRequest) error {
+	if req.Code == "" {
+		return errors.New("auth code required")
+	}
+	appConf, err := getAppConfig(data.MastodonConfig.Server, data.LiveAvatar)
+	if err != nil {
+		return err
+	}
+
+	data.AuthCode = req.Code
+	client := mastodon.NewClient(data.MastodonConfig)
+	client.UserAgent = USER_AGENT
+	if err := client.AuthenticateToken(ctx, req.Code, appConf.RedirectURIs); err != nil {
+		return err
+	}
+	data.MastodonConfig = client.Config
+
+	return nil
+}
+
+func (p *mastodonProvider) GetCurrentAccount(ctx context.Context, conf *mastodon.Config) (*mastodon.Account, error) {
+	client := mastodon.NewClient(conf)
+	client.UserAgent = USER_AGENT
+	return client.GetAccountCurrentUser(ctx)
+}
+
+func (p *mastodonProvider) GetRelationship(ctx context.Context, conf *mastodon.Config, target *AudonUser) (*mastodon.Relationship, error) {
+	client := mastodon.NewClient(conf)
+	client.UserAgent = USER_AGENT
+	acc, err := resolveAccount(ctx, client, target.Webfinger, target.RemoteURL)
+	if err != nil {
+		return nil, err
+	}
+	rels, err := client.GetAccountRelationships(ctx, []string{string(acc.ID)})
+	if err != nil {
+		return nil, err
+	}
+	if len(rels) != 1 {
+		return nil, errors.New("relationship not found")
+	}
+	return rels[0], nil
+}
+
+func (p *mastodonProvider) Revoke(ctx context.Context, conf *mastodon.Config) error {
+	u, err := url.Parse(conf.Server)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath("oauth", "revoke")
+	formValues := url.Values{}
+	formValues.Add("client_id", conf.ClientID)
+	formValues.Add("client_secret", conf.ClientSecret)
+	formValues.Add("token", conf.AccessToken)
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", USER_AGENT)
+	resp, err := apHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
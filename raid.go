@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/livekit/protocol/livekit"
+	mastodon "github.com/mattn/go-mastodon"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	// Conditions on the Mastodon account to join the room, zero values mean no condition.
+	// Host, cohosts, speakers, invitees and users admitted from the lobby are not filtered.
+	JoinFilter struct {
+		MinAccountAgeDays int `bson:"min_account_age_days" json:"min_account_age_days" validate:"gte=0"`
+		MinFollowers      int `bson:"min_followers" json:"min_followers" validate:"gte=0"`
+		MinStatuses       int `bson:"min_statuses" json:"min_statuses" validate:"gte=0"`
+		// Accounts not passing the filter wait in the lobby instead of being rejected
+		ApproveNewAccounts bool `bson:"approve_new_accounts" json:"approve_new_accounts"`
+	}
+
+	RaidModeRequest struct {
+		Enabled bool `json:"enabled"`
+	}
+)
+
+// Filter applied in raid mode, combined with the filter of the room
+var RAID_JOIN_FILTER = &JoinFilter{
+	MinAccountAgeDays:  30,
+	MinFollowers:       1,
+	MinStatuses:        10,
+	ApproveNewAccounts: true,
+}
+
+// Participants who joined within this period are checked again when raid mode is turned on
+const RAID_SWEEP_WINDOW = 15 * time.Minute
+
+// handler for PUT to /api/room/:id/raid, intended to be called by host or cohost
+func updateRaidModeHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID)
+	if lkRoom == nil {
+		return ErrRoomNotFound
+	}
+	meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	iam := c.Get("user").(*AudonUser)
+	if !meta.IsHost(iam) && !meta.IsCoHost(iam) {
+		return ErrOperationNotPermitted
+	}
+
+	req := new(RaidModeRequest)
+	if err := c.Bind(req); err != nil {
+		return ErrInvalidRequestFormat
+	}
+
+	meta.RaidMode = req.Enabled
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	if _, err := coll.UpdateOne(c.Request().Context(),
+		bson.D{{Key: "room_id", Value: roomID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "raid_mode", Value: meta.RaidMode}}}}); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if meta.RaidMode {
+		if err := meta.sweepRecentJoiners(c.Request().Context()); err != nil {
+			c.Logger().Error(err)
+		}
+	}
+
+	if err := updateRoomMetadata(c.Request().Context(), meta); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	action := "raid_mode_off"
+	if meta.RaidMode {
+		action = "raid_mode_on"
+	}
+	if err := meta.logModeration(c.Request().Context(), iam, action, nil, ""); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// Removes participants who joined recently and do not pass the filter.
+// They are put in the lobby so that host or cohost can still admit them.
+// The caller should update the room metadata.
+func (r *RoomMetadata) sweepRecentJoiners(ctx context.Context) error {
+	filter := r.EffectiveJoinFilter()
+	if filter == nil {
+		return nil
+	}
+
+	participantsInfo, err := lkRoomServiceClient.ListParticipants(ctx, &livekit.ListParticipantsRequest{Room: r.RoomID})
+	if err != nil {
+		return err
+	}
+	since := time.Now().Add(-RAID_SWEEP_WINDOW).Unix()
+	for _, p := range participantsInfo.GetParticipants() {
+		if p.GetJoinedAt() < since {
+			continue
+		}
+		// guests cannot wait in the lobby, so they are removed and not allowed to rejoin
+		if isGuestIdentity(p.GetIdentity()) {
+			r.Kicked = append(r.Kicked, &AudonUser{AudonID: p.GetIdentity()})
+			if _, err := lkRoomServiceClient.RemoveParticipant(ctx, &livekit.RoomParticipantIdentity{
+				Room:     r.RoomID,
+				Identity: p.GetIdentity(),
+			}); err != nil {
+				return err
+			}
+			if err := r.logModeration(ctx, nil, "raid_sweep", &AudonUser{AudonID: p.GetIdentity()}, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		user, err := findUserByID(ctx, p.GetIdentity())
+		if err != nil || r.IsExemptFromJoinFilter(user) {
+			continue
+		}
+
+		// accounts which cannot be checked are regarded as not passing
+		passed := false
+		if acc, err := user.GetCurrentAccount(ctx); err == nil {
+			passed = filter.Passes(acc)
+		}
+		if passed {
+			continue
+		}
+
+		if err := r.addToLobby(ctx, user); err != nil {
+			return err
+		}
+		if _, err := lkRoomServiceClient.RemoveParticipant(ctx, &livekit.RoomParticipantIdentity{
+			Room:     r.RoomID,
+			Identity: user.AudonID,
+		}); err != nil {
+			return err
+		}
+		if err := r.logModeration(ctx, nil, "raid_sweep", user, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the filter of the room tightened in raid mode, or nil if nothing is filtered
+func (r *Room) EffectiveJoinFilter() *JoinFilter {
+	if !r.RaidMode {
+		if r.JoinFilter == nil || *r.JoinFilter == (JoinFilter{}) {
+			return nil
+		}
+		return r.JoinFilter
+	}
+
+	filter := *RAID_JOIN_FILTER
+	if r.JoinFilter != nil {
+		if r.JoinFilter.MinAccountAgeDays > filter.MinAccountAgeDays {
+			filter.MinAccountAgeDays = r.JoinFilter.MinAccountAgeDays
+		}
+		if r.JoinFilter.MinFollowers > filter.MinFollowers {
+			filter.MinFollowers = r.JoinFilter.MinFollowers
+		}
+		if r.JoinFilter.MinStatuses > filter.MinStatuses {
+			filter.MinStatuses = r.JoinFilter.MinStatuses
+		}
+	}
+	return &filter
+}
+
+func (r *RoomMetadata) IsExemptFromJoinFilter(u *AudonUser) bool {
+	return r.IsHost(u) || r.IsCoHost(u) || r.IsSpeaker(u) || r.IsInvited(u) || r.IsAdmitted(u)
+}
+
+func (f *JoinFilter) Passes(acc *mastodon.Account) bool {
+	if acc == nil {
+		return false
+	}
+	minCreatedAt := time.Now().AddDate(0, 0, -f.MinAccountAgeDays)
+	return !acc.CreatedAt.After(minCreatedAt) &&
+		acc.FollowersCount >= int64(f.MinFollowers) &&
+		acc.StatusesCount >= int64(f.MinStatuses)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mastodon "github.com/mattn/go-mastodon"
+)
+
+func TestJoinFilterPasses(t *testing.T) {
+	filter := &JoinFilter{MinAccountAgeDays: 30, MinFollowers: 1, MinStatuses: 10}
+	account := func(ageDays, followers, statuses int) *mastodon.Account {
+		return &mastodon.Account{
+			CreatedAt:      time.Now().AddDate(0, 0, -ageDays),
+			FollowersCount: int64(followers),
+			StatusesCount:  int64(statuses),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter *JoinFilter
+		acc    *mastodon.Account
+		want   bool
+	}{
+		{"meets every requirement", filter, account(31, 1, 10), true},
+		{"well above the requirements", filter, account(365, 100, 1000), true},
+		{"account too new", filter, account(29, 1, 10), false},
+		{"no followers", filter, account(31, 0, 10), false},
+		{"too few statuses", filter, account(31, 1, 9), false},
+		{"account not fetched", filter, nil, false},
+		{"empty filter passes a new account", &JoinFilter{}, account(0, 0, 0), true},
+		{"raid mode filter", RAID_JOIN_FILTER, account(1, 0, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Passes(tt.acc); got != tt.want {
+				t.Errorf("Passes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEffectiveJoinFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		room *Room
+		want *JoinFilter
+	}{
+		{"no filter", &Room{}, nil},
+		{"empty filter", &Room{JoinFilter: &JoinFilter{}}, nil},
+		{"room filter", &Room{JoinFilter: &JoinFilter{MinFollowers: 5}}, &JoinFilter{MinFollowers: 5}},
+		{"raid mode", &Room{RaidMode: true}, RAID_JOIN_FILTER},
+		{
+			"raid mode keeps the stricter requirements of the room",
+			&Room{RaidMode: true, JoinFilter: &JoinFilter{MinAccountAgeDays: 90, MinFollowers: 0, MinStatuses: 50}},
+			&JoinFilter{MinAccountAgeDays: 90, MinFollowers: RAID_JOIN_FILTER.MinFollowers, MinStatuses: 50, ApproveNewAccounts: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.room.EffectiveJoinFilter()
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("EffectiveJoinFilter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
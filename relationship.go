@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/labstack/echo/v4"
+	mastodon "github.com/mattn/go-mastodon"
+)
+
+// Returned when the account cannot be found on the instance of the user in the session
+var errAccountNotResolved = errors.New("account not resolved")
+
+// Returns the relationship between the user in the session and the host, seen from the user's instance.
+// Results are cached per pair of the users so that rejoining doesn't hit the instance every time.
+func getRelationshipWithHost(c echo.Context, room *Room) (*mastodon.Relationship, error) {
+	user, _ := c.Get("user").(*AudonUser)
+	if user == nil {
+		return nil, ErrInvalidSession
+	}
+	cacheKey := user.AudonID + "/" + room.Host.AudonID
+	if item := relationshipCache.Get(cacheKey); item != nil {
+		return item.Value(), nil
+	}
+
+	data, _ := getSessionData(c)
+	if data == nil || data.MastodonConfig == nil || data.MastodonConfig.AccessToken == "" {
+		return nil, ErrInvalidSession
+	}
+	rel, err := getProvider(data.Software).GetRelationship(c.Request().Context(), data.MastodonConfig, room.Host)
+	if err != nil {
+		c.Logger().Warn(err)
+		return nil, ErrRelationshipUnverifiable
+	}
+
+	relationshipCache.Set(cacheKey, rel, ttlcache.DefaultTTL)
+	return rel, nil
+}
+
+// Finds the account on the instance of the client.
+// The account is looked up first, then searched with resolve=true so that the instance fetches it
+// if it has never seen the account. Results are confirmed by the account URL, not to pick a wrong account.
+func resolveAccount(ctx context.Context, c *mastodon.Client, webfinger, accountURL string) (*mastodon.Account, error) {
+	if acc, err := lookupAccount(ctx, c, webfinger); err == nil && isSameAccountURL(acc.URL, accountURL) {
+		return acc, nil
+	}
+
+	results, err := c.Search(ctx, "@"+webfinger, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range results.Accounts {
+		if isSameAccountURL(acc.URL, accountURL) {
+			return acc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", errAccountNotResolved, webfinger)
+}
+
+// go-mastodon doesn't support /api/v1/accounts/lookup, which finds only accounts known to the instance
+func lookupAccount(ctx context.Context, c *mastodon.Client, webfinger string) (*mastodon.Account, error) {
+	u, err := url.Parse(c.Config.Server)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "/api/v1/accounts/lookup")
+	u.RawQuery = url.Values{"acct": {webfinger}}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.Config.AccessToken)
+	req.Header.Set("User-Agent", USER_AGENT)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed: %d", resp.StatusCode)
+	}
+
+	var acc mastodon.Account
+	if err := json.NewDecoder(resp.Body).Decode(&acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+func isSameAccountURL(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSuffix(a, "/"), strings.TrimSuffix(b, "/"))
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaevor/go-nanoid"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/livekit/protocol/livekit"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	Report struct {
+		ReportID   string          `bson:"report_id" json:"report_id"`
+		RoomID     string          `bson:"room_id" json:"room_id"`
+		ReporterID string          `bson:"reporter_id" json:"reporter_id"`
+		Reporter   string          `bson:"reporter" json:"reporter"`
+		TargetID   string          `bson:"target_id" json:"target_id"` // empty if the room itself is reported
+		Category   string          `bson:"category" json:"category"`
+		Comment    string          `bson:"comment" json:"comment"`
+		Snapshot   *ReportSnapshot `bson:"snapshot" json:"snapshot"`
+		Status     string          `bson:"status" json:"status"`
+		ResolvedBy string          `bson:"resolved_by" json:"resolved_by"`
+		ResolvedAt time.Time       `bson:"resolved_at" json:"resolved_at"`
+		CreatedAt  time.Time       `bson:"created_at" json:"created_at"`
+	}
+
+	// State of the room at the time of the report, so that admins can review it after the room ends
+	ReportSnapshot struct {
+		Room         *RoomMetadata          `bson:"room" json:"room"`
+		Participants []*ReportedParticipant `bson:"participants" json:"participants"`
+	}
+
+	ReportedParticipant struct {
+		Identity string    `bson:"identity" json:"identity"`
+		Name     string    `bson:"name" json:"name"`
+		Metadata string    `bson:"metadata" json:"metadata"`
+		JoinedAt time.Time `bson:"joined_at" json:"joined_at"`
+	}
+
+	ReportRequest struct {
+		RoomID   string `json:"room_id" validate:"required,printascii"`
+		TargetID string `json:"target_id" validate:"omitempty,printascii"`
+		Category string `json:"category" validate:"required,oneof=spam harassment hate sexual violence illegal other"`
+		Comment  string `json:"comment" validate:"max=1000"`
+	}
+
+	ReportUpdateRequest struct {
+		Status string `json:"status" validate:"required,oneof=open resolved dismissed"`
+	}
+)
+
+const (
+	REPORT_OPEN      = "open"
+	REPORT_RESOLVED  = "resolved"
+	REPORT_DISMISSED = "dismissed"
+
+	// Each user can report REPORT_RATE_LIMIT times in REPORT_RATE_WINDOW
+	REPORT_RATE_LIMIT  = 5
+	REPORT_RATE_WINDOW = time.Hour
+)
+
+// handler for POST to /api/report
+func createReportHandler(c echo.Context) error {
+	req := new(ReportRequest)
+	if err := c.Bind(req); err != nil {
+		return ErrInvalidRequestFormat
+	}
+	if err := mainValidator.Struct(req); err != nil {
+		return wrapValidationError(err)
+	}
+
+	room, err := findRoomByID(c.Request().Context(), req.RoomID)
+	if err != nil {
+		return ErrRoomNotFound
+	}
+
+	reporter := c.Get("user").(*AudonUser)
+	coll := mainDB.Collection(COLLECTION_REPORT)
+	// the same report is accepted only once until admins handle it
+	if count, err := coll.CountDocuments(c.Request().Context(), bson.D{
+		{Key: "room_id", Value: room.RoomID},
+		{Key: "reporter_id", Value: reporter.AudonID},
+		{Key: "target_id", Value: req.TargetID},
+		{Key: "status", Value: REPORT_OPEN},
+	}); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	} else if count > 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	count := 0
+	ttl := ttlcache.DefaultTTL
+	if item := reportRateCache.Get(reporter.AudonID); item != nil {
+		count = item.Value()
+		ttl = time.Until(item.ExpiresAt())
+	}
+	if count >= REPORT_RATE_LIMIT {
+		return ErrTooManyRequests
+	}
+
+	// only those who are or have been in the room can report
+	snapshot := takeReportSnapshot(c.Request().Context(), room)
+	if !snapshot.hasParticipant(reporter.AudonID) && !room.HasParticipated(reporter) {
+		return ErrOperationNotPermitted
+	}
+	reportRateCache.Set(reporter.AudonID, count+1, ttl)
+
+	canonic, err := nanoid.Standard(16)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	report := &Report{
+		ReportID:   canonic(),
+		RoomID:     room.RoomID,
+		ReporterID: reporter.AudonID,
+		Reporter:   reporter.Webfinger,
+		TargetID:   req.TargetID,
+		Category:   req.Category,
+		Comment:    req.Comment,
+		Snapshot:   snapshot,
+		Status:     REPORT_OPEN,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if _, err := coll.InsertOne(c.Request().Context(), report); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if mainConfig.Bot.Enable && mainConfig.Bot.NotifyReports && len(mainConfig.Admins) > 0 {
+		if err := notifyReport(c.Request().Context(), room, report); err != nil {
+			c.Logger().Error(err)
+		}
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// handler for GET to /api/report, for admins only
+func listReportsHandler(c echo.Context) error {
+	user := c.Get("user").(*AudonUser)
+	if !user.IsAdmin() {
+		return ErrOperationNotPermitted
+	}
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = REPORT_OPEN
+	}
+	if err := mainValidator.Var(status, "oneof=open resolved dismissed"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	coll := mainDB.Collection(COLLECTION_REPORT)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(MODERATION_LOG_MAX_LIMIT)
+	cur, err := coll.Find(c.Request().Context(), bson.D{{Key: "status", Value: status}}, opts)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	reports := []*Report{}
+	if err := cur.All(c.Request().Context(), &reports); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, reports)
+}
+
+// handler for PUT to /api/report/:id, for admins only
+func updateReportHandler(c echo.Context) error {
+	reportID := c.Param("id")
+	if err := mainValidator.Var(&reportID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	user := c.Get("user").(*AudonUser)
+	if !user.IsAdmin() {
+		return ErrOperationNotPermitted
+	}
+
+	req := new(ReportUpdateRequest)
+	if err := c.Bind(req); err != nil {
+		return ErrInvalidRequestFormat
+	}
+	if err := mainValidator.Struct(req); err != nil {
+		return wrapValidationError(err)
+	}
+
+	var report Report
+	coll := mainDB.Collection(COLLECTION_REPORT)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := coll.FindOneAndUpdate(c.Request().Context(),
+		bson.D{{Key: "report_id", Value: reportID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: req.Status},
+			{Key: "resolved_by", Value: user.AudonID},
+			{Key: "resolved_at", Value: time.Now().UTC()},
+		}}}, opts).Decode(&report); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "report_not_found")
+	}
+
+	entry := &ModerationLog{
+		RoomID: report.RoomID,
+		Action: "report_" + req.Status,
+		Detail: report.ReportID,
+	}
+	if report.Snapshot != nil && report.Snapshot.Room != nil && report.Snapshot.Room.Host != nil {
+		entry.HostID = report.Snapshot.Room.Host.AudonID
+	}
+	if err := insertModerationLog(c.Request().Context(), entry, user, &AudonUser{AudonID: report.TargetID}); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.JSON(http.StatusOK, &report)
+}
+
+// Returns the live metadata and participants if the room is live, otherwise the stored room
+func takeReportSnapshot(ctx context.Context, room *Room) *ReportSnapshot {
+	snapshot := &ReportSnapshot{
+		Room:         &RoomMetadata{Room: room},
+		Participants: []*ReportedParticipant{},
+	}
+
+	lkRoom, _ := getRoomInLivekit(ctx, room.RoomID)
+	if lkRoom == nil {
+		return snapshot
+	}
+	if meta, err := getRoomMetadataFromLivekitRoom(lkRoom); err == nil {
+		snapshot.Room = meta
+	}
+	participantsInfo, err := lkRoomServiceClient.ListParticipants(ctx, &livekit.ListParticipantsRequest{Room: room.RoomID})
+	if err != nil {
+		log.Println(err)
+		return snapshot
+	}
+	for _, p := range participantsInfo.GetParticipants() {
+		snapshot.Participants = append(snapshot.Participants, &ReportedParticipant{
+			Identity: p.GetIdentity(),
+			Name:     p.GetName(),
+			Metadata: p.GetMetadata(),
+			JoinedAt: time.Unix(p.GetJoinedAt(), 0).UTC(),
+		})
+	}
+
+	return snapshot
+}
+
+func (s *ReportSnapshot) hasParticipant(identity string) bool {
+	for _, p := range s.Participants {
+		if p.Identity == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// Records that the user got a token for the room, so that they can report it after leaving
+func (r *Room) recordParticipant(ctx context.Context, user *AudonUser) error {
+	if r.HasParticipated(user) {
+		return nil
+	}
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "room_id", Value: r.RoomID}},
+		bson.D{{Key: "$addToSet", Value: bson.D{{Key: "participants", Value: user.AudonID}}}})
+	return err
+}
+
+func (r *Room) HasParticipated(user *AudonUser) bool {
+	if user == nil {
+		return false
+	}
+	for _, id := range r.Participants {
+		if id == user.AudonID {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues a direct message from the bot account mentioning the admins.
+// Only the admins are mentioned, the title, the comment and the host are escaped not to notify others of the report.
+func notifyReport(ctx context.Context, room *Room, report *Report) error {
+	mentions := make([]string, 0, len(mainConfig.Admins))
+	for _, admin := range mainConfig.Admins {
+		mentions = append(mentions, "@"+admin)
+	}
+
+	localizer := i18n.NewLocalizer(localeBundle)
+	header := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "ReportNotification",
+			Other: "New report ({{.Category}}) on a room by @{{.Host}}",
+		},
+		TemplateData: map[string]string{
+			"Category": report.Category,
+			"Host":     room.Host.Webfinger,
+		},
+	})
+
+	messages := []string{
+		strings.Join(mentions, " "),
+		escapeMentions(header),
+		fmt.Sprintf(":udon: %s\nhttps://%s/r/%s", escapeMentions(room.Title), mainConfig.LocalDomain, room.RoomID),
+	}
+	if report.Comment != "" {
+		messages = append(messages, escapeMentions(report.Comment))
+	}
+
+	return enqueueBotPost(ctx, &OutboxPost{
+		Key:        outboxKey(room.RoomID, OUTBOX_REPORT, report.ReportID),
+		RoomID:     room.RoomID,
+		Kind:       OUTBOX_REPORT,
+		Bot:        mainConfig.Bot.Fallback.Tag,
+		Status:     strings.Join(messages, "\n\n"),
+		Visibility: "direct",
+	})
+}
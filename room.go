@@ -7,6 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,10 +19,18 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/livekit/protocol/auth"
 	"github.com/livekit/protocol/livekit"
+	"github.com/twitchtv/twirp"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// Tokens are short-lived so that revoked users cannot keep reconnecting with them.
+// Clients get a new one from refreshRoomTokenHandler.
+const ROOM_TOKEN_TTL = 10 * time.Minute
+
+// Extra slots in MaxParticipants, see (*Room).ParticipantCap
+const ROOM_PARTICIPANT_MARGIN = 5
+
 // handler for POST to /api/room
 func createRoomHandler(c echo.Context) error {
 	room := new(Room)
@@ -34,21 +44,16 @@ func createRoomHandler(c echo.Context) error {
 	host := c.Get("user").(*AudonUser)
 	room.Host = host
 
-	// check if user is already hosting or cohosting
-	lkRooms, err := host.GetCurrentLivekitRooms(c.Request().Context())
-	if err != nil {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusInternalServerError)
+	if err := checkRoomList(c, room.Restriction, room.ListID); err != nil {
+		return err
 	}
-	for _, r := range lkRooms {
-		meta, err := getRoomMetadataFromLivekitRoom(r)
-		if err != nil {
-			c.Logger().Error(err)
-			return echo.NewHTTPError(http.StatusInternalServerError)
-		}
-		if meta.IsHost(host) || meta.IsCoHost(host) {
-			return ErrOperationNotPermitted
-		}
+	if err := storeHostCredential(c, room); err != nil {
+		return err
+	}
+
+	// check if user is already hosting or cohosting
+	if err := checkNotHosting(c, host); err != nil {
+		return err
 	}
 
 	coll := mainDB.Collection(COLLECTION_ROOM)
@@ -67,30 +72,48 @@ func createRoomHandler(c echo.Context) error {
 
 	room.CreatedAt = now
 
-	// if cohosts are already registered, retrieve their data from DB
-	for i, cohost := range room.CoHosts {
-		cohostUser, err := findUserByWebfinger(c.Request().Context(), cohost.Webfinger)
-		if err == nil {
-			room.CoHosts[i] = cohostUser
-		}
+	if !room.EndsAt.IsZero() && room.EndsAt.Before(now) {
+		return ErrInvalidRequestFormat
 	}
+	room.EndsAt = room.limitEndsAt(room.EndsAt)
+	room.EndWarnings = []int{}
+
+	// cohosts in the request need to accept the invitation in the room
+	requestedCoHosts := room.CoHosts
+	room.CoHosts = nil
+	room.applyCoHostList(c.Request().Context(), requestedCoHosts)
+	resolveInvitees(c.Request().Context(), room.Invitees)
 
 	if _, insertErr := coll.InsertOne(c.Request().Context(), room); insertErr != nil {
 		c.Logger().Error(insertErr)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	// Create livekit room
-	roomMetadata := &RoomMetadata{Room: room, Speakers: []*AudonUser{}, Kicked: []*AudonUser{}, MastodonAccounts: make(map[string]*MastodonAccount)}
-	metadata, _ := json.Marshal(roomMetadata)
-	_, err = lkRoomServiceClient.CreateRoom(c.Request().Context(), &livekit.CreateRoomRequest{
-		Name:     room.RoomID,
-		Metadata: string(metadata),
-	})
-	if err != nil {
+	if err := startLivekitRoom(c.Request().Context(), room, c.Logger()); err != nil {
 		c.Logger().Error(err)
 		return echo.NewHTTPError(http.StatusConflict)
 	}
+
+	return c.String(http.StatusCreated, room.RoomID)
+}
+
+// Creates the LiveKit room with the initial metadata, which is closed if no one joins before the timeout
+func startLivekitRoom(ctx context.Context, room *Room, logger echo.Logger) error {
+	kicked := room.Kicked
+	if kicked == nil {
+		kicked = []*AudonUser{}
+	}
+	roomMetadata := &RoomMetadata{Room: room, Speakers: []*AudonUser{}, Kicked: kicked, Pending: []*AudonUser{}, Admitted: []*AudonUser{}, MastodonAccounts: make(map[string]*MastodonAccount)}
+	metadata, _ := json.Marshal(roomMetadata)
+	// LiveKit rejects participants beyond this, tokens are checked too to tell users the room is full
+	createRequest := &livekit.CreateRoomRequest{
+		Name:            room.RoomID,
+		Metadata:        string(metadata),
+		MaxParticipants: room.ParticipantCap(),
+	}
+	if _, err := lkRoomServiceClient.CreateRoom(ctx, createRequest); err != nil {
+		return err
+	}
 	countdown := time.NewTimer(mainConfig.Livekit.EmptyRoomTimeout)
 	orphanRooms.Set(room.RoomID, true, ttlcache.DefaultTTL)
 
@@ -109,15 +132,82 @@ func createRoomHandler(c echo.Context) error {
 				logger.Error(err)
 			}
 		}
-	}(room, c.Logger())
+	}(room, logger)
 
-	return c.String(http.StatusCreated, room.RoomID)
+	return nil
+}
+
+// Applies the limits of the room to the live LiveKit room.
+// CreateRoom updates MaxParticipants of an existing room, and the cap never goes below the current participants
+// so that nobody in the room is dropped when the host lowers the limits.
+func updateParticipantCap(ctx context.Context, room *Room, current uint32) error {
+	maxParticipants := room.ParticipantCap()
+	if maxParticipants == 0 {
+		// 0 leaves the current cap unchanged in LiveKit
+		maxParticipants = math.MaxUint32
+	} else if min := current + ROOM_PARTICIPANT_MARGIN; maxParticipants < min {
+		maxParticipants = min
+	}
+	_, err := lkRoomServiceClient.CreateRoom(ctx, &livekit.CreateRoomRequest{
+		Name:            room.RoomID,
+		MaxParticipants: maxParticipants,
+	})
+	return err
+}
+
+// Stores the host's token if the room needs it to check who can join,
+// the blocks and the list are fetched while the host is offline or logged in on another device.
+func storeHostCredential(c echo.Context, room *Room) error {
+	if !room.NeedsHostCredential() {
+		return nil
+	}
+	data, err := getSessionData(c)
+	if err != nil {
+		return ErrCredentialUnavailable
+	}
+	if err := storeUserCredential(c.Request().Context(), data); err == ErrCredentialUnavailable {
+		return err
+	} else if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// Returns an error if the user is already hosting or cohosting a live room
+func checkNotHosting(c echo.Context, user *AudonUser) error {
+	lkRooms, err := user.GetCurrentLivekitRooms(c.Request().Context())
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	for _, r := range lkRooms {
+		meta, err := getRoomMetadataFromLivekitRoom(r)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if meta.IsHost(user) || meta.IsCoHost(user) {
+			return ErrOperationNotPermitted
+		}
+	}
+	return nil
 }
 
 type RoomUpdateRequest struct {
-	Title       string          `bson:"title" json:"title" validate:"required,max=100,printascii|multibyte"`
-	Description string          `bson:"description" json:"description" validate:"max=500,ascii|multibyte"`
-	Restriction JoinRestriction `bson:"restriction" json:"restriction"`
+	Title        string          `bson:"title" json:"title" validate:"required,max=100,printascii|multibyte"`
+	Description  string          `bson:"description" json:"description" validate:"max=500,ascii|multibyte"`
+	Restriction  JoinRestriction `bson:"restriction" json:"restriction"`
+	ListID       string          `bson:"list_id" json:"list_id" validate:"omitempty,printascii"`
+	DenyBlocked  bool            `bson:"deny_blocked" json:"deny_blocked"`
+	Invitees     []*AudonUser    `bson:"invitees" json:"invitees"`
+	AllowGuests  bool            `bson:"allow_guests" json:"allow_guests"`
+	Lobby        bool            `bson:"lobby" json:"lobby"`
+	MaxListeners int             `bson:"max_listeners" json:"max_listeners" validate:"gte=0"`
+	MaxSpeakers  int             `bson:"max_speakers" json:"max_speakers" validate:"gte=0"`
+	EndsAt       time.Time       `bson:"ends_at" json:"ends_at"`
+	JoinFilter   *JoinFilter     `bson:"join_filter" json:"join_filter" validate:"omitempty"`
+	CoHosts      []*AudonUser    `bson:"-" json:"cohosts"` // stored separately, see applyCoHostList
 }
 
 func updateRoomHandler(c echo.Context) (err error) {
@@ -152,6 +242,20 @@ func updateRoomHandler(c echo.Context) (err error) {
 	if err = mainValidator.Struct(req); err != nil {
 		return wrapValidationError(err)
 	}
+	if err = checkRoomList(c, req.Restriction, req.ListID); err != nil {
+		return err
+	}
+	if err = storeHostCredential(c, &Room{Restriction: req.Restriction, DenyBlocked: req.DenyBlocked}); err != nil {
+		return err
+	}
+	if req.Invitees == nil {
+		req.Invitees = []*AudonUser{}
+	}
+	resolveInvitees(c.Request().Context(), req.Invitees)
+	if !req.EndsAt.IsZero() && req.EndsAt.Before(time.Now()) {
+		return ErrInvalidRequestFormat
+	}
+	req.EndsAt = room.limitEndsAt(req.EndsAt)
 
 	coll := mainDB.Collection(COLLECTION_ROOM)
 	if _, err = coll.UpdateOne(c.Request().Context(),
@@ -160,16 +264,53 @@ func updateRoomHandler(c echo.Context) (err error) {
 		c.Logger().Error(err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
+	// warn again if the end time has changed
+	if !req.EndsAt.Equal(room.EndsAt) {
+		if _, err = coll.UpdateOne(c.Request().Context(),
+			bson.D{{Key: "room_id", Value: roomID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "end_warnings", Value: []int{}}}}}); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+	if req.CoHosts != nil {
+		removed := room.applyCoHostList(c.Request().Context(), req.CoHosts)
+		if err = room.storeCoHosts(c.Request().Context()); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if lkRoom != nil && len(removed) > 0 {
+			room.dropCoHosts(c.Request().Context(), removed, c.Logger())
+		}
+	}
 
 	if lkRoom != nil {
 		room.Title = req.Title
 		room.Description = req.Description
 		room.Restriction = req.Restriction
+		room.ListID = req.ListID
+		room.DenyBlocked = req.DenyBlocked
+		room.Invitees = req.Invitees
+		room.AllowGuests = req.AllowGuests
+		room.Lobby = req.Lobby
+		room.MaxListeners = req.MaxListeners
+		room.MaxSpeakers = req.MaxSpeakers
+		room.EndsAt = req.EndsAt
+		room.JoinFilter = req.JoinFilter
 		newMetadata, _ := json.Marshal(room)
 		if _, err := lkRoomServiceClient.UpdateRoomMetadata(c.Request().Context(), &livekit.UpdateRoomMetadataRequest{Room: roomID, Metadata: string(newMetadata)}); err != nil {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusInternalServerError)
 		}
+		if err := updateParticipantCap(c.Request().Context(), room.Room, lkRoom.GetNumParticipants()); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	detail, _ := json.Marshal(req)
+	if err := room.logModeration(c.Request().Context(), user, "edit_room", nil, string(detail)); err != nil {
+		c.Logger().Error(err)
 	}
 
 	return c.JSON(http.StatusOK, room)
@@ -254,43 +395,47 @@ func joinRoomHandler(c echo.Context) (err error) {
 
 	// check if room has already ended
 	if !room.EndedAt.IsZero() && room.EndedAt.Before(now) {
+		if room.IsHost(user) && room.IsResumable() {
+			return ErrRoomResumable
+		}
 		return ErrAlreadyEnded
 	}
 
 	canTalk := room.IsHost(user) || room.IsCoHost(user) // host and cohost can talk from the beginning
 
-	// check room restriction
-	if room.IsPrivate() && !canTalk {
-		return c.String(http.StatusForbidden, string(room.Restriction))
-	}
-	if !canTalk && (room.IsFollowingOnly() || room.IsFollowerOnly() || room.IsFollowingOrFollowerOnly() || room.IsMutualOnly()) {
-		data, _ := getSessionData(c)
-		mastoClient := getMastodonClient(data)
-		if mastoClient == nil {
-			return echo.NewHTTPError(http.StatusInternalServerError)
+	// tell the host to log in again rather than letting the room deny everyone without the token
+	if room.IsHost(user) {
+		if err := storeHostCredential(c, room); err != nil {
+			return err
 		}
-		search, err := mastoClient.AccountsSearch(c.Request().Context(), room.Host.Webfinger, 1)
+	}
+
+	// invited users can join regardless of the restriction
+	invited := room.IsInvited(user)
+	invitedAsSpeaker := false
+	var invite *Invite
+	if token := c.QueryParam("invite"); token != "" && !canTalk {
+		// redeemed after checking bans and kicks
+		invite, err = findValidInvite(c.Request().Context(), token, room.RoomID)
 		if err != nil {
-			c.Logger().Error(err)
-			return echo.NewHTTPError(http.StatusInternalServerError)
-		}
-		if len(search) != 1 {
-			return ErrOperationNotPermitted
+			return err
 		}
-		rels, err := mastoClient.GetAccountRelationships(c.Request().Context(), []string{string(search[0].ID)})
-		if err != nil {
+		invited = true
+		invitedAsSpeaker = invite.Role == "speaker"
+	}
+
+	// check room restriction
+	if !canTalk {
+		if denied, err := isDeniedByHost(c.Request().Context(), room, user); err != nil {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusInternalServerError)
+		} else if denied {
+			return ErrBannedByHost
 		}
-		if len(rels) != 1 {
-			return ErrOperationNotPermitted
-		}
-		rel := rels[0]
-		if (room.IsFollowingOnly() && !rel.FollowedBy) ||
-			(room.IsFollowerOnly() && !rel.Following) ||
-			(room.IsFollowingOrFollowerOnly() && !(rel.FollowedBy || rel.Following)) ||
-			(room.IsMutualOnly() && !(rel.FollowedBy && rel.Following)) {
-			return c.String(http.StatusForbidden, string(room.Restriction))
+		if !invited {
+			if err := checkJoinRestriction(c, room); err != nil {
+				return respondJoinError(c, err)
+			}
 		}
 	}
 
@@ -301,9 +446,44 @@ func joinRoomHandler(c echo.Context) (err error) {
 	roomMetadata, _ := getRoomMetadataFromLivekitRoom(lkRoom)
 
 	// return 403 if one has been kicked
-	for _, kicked := range roomMetadata.Kicked {
-		if kicked.Equal(user) {
-			return echo.NewHTTPError(http.StatusForbidden)
+	if roomMetadata.IsKicked(user) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	// new accounts are rejected or need approval if the room filters them, e.g. in raid mode
+	needsApproval := false
+	if filter := roomMetadata.EffectiveJoinFilter(); filter != nil && !canTalk && !invited && !roomMetadata.IsExemptFromJoinFilter(user) {
+		valid, acc, err := verifyTokenInSession(c)
+		if err != nil {
+			c.Logger().Error(err)
+		}
+		if !valid {
+			return ErrAccountUnavailable
+		}
+		if !filter.Passes(acc) {
+			if !filter.ApproveNewAccounts {
+				return ErrJoinFiltered
+			}
+			needsApproval = true
+		}
+	}
+
+	// wait in the lobby until host or cohost admits, the client should long-poll waitLobbyHandler
+	if (roomMetadata.Lobby || needsApproval) && !canTalk && !invited && !roomMetadata.IsAdmitted(user) {
+		if err := roomMetadata.addToLobby(c.Request().Context(), user); err != nil {
+			c.Logger().Error(err)
+		}
+		if err := updateRoomMetadata(c.Request().Context(), roomMetadata); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		return c.JSON(http.StatusAccepted, &LobbyStatus{Status: LOBBY_PENDING})
+	}
+
+	if invitedAsSpeaker && !roomMetadata.IsSpeaker(user) {
+		// join as a listener if speakers are full
+		if limit := roomMetadata.SpeakerLimit(); limit == 0 || len(roomMetadata.Speakers) < limit {
+			roomMetadata.Speakers = append(roomMetadata.Speakers, user)
 		}
 	}
 
@@ -315,11 +495,34 @@ func joinRoomHandler(c echo.Context) (err error) {
 		}
 	}
 
+	// reject listeners if the room is full, skipping the user rejoining from another device
+	if limit := roomMetadata.ListenerLimit(); !canTalk && limit > 0 && !roomMetadata.IsUserInLivekitRoom(c.Request().Context(), user.AudonID) {
+		count, err := roomMetadata.CountListeners(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if count >= limit {
+			return ErrRoomFull
+		}
+	}
+
+	// the user is not denied by now
+	if invite != nil {
+		if err := invite.redeem(c.Request().Context(), user); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
 	token, err := getRoomToken(room, user, canTalk)
 	if err != nil {
 		c.Logger().Error(err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
+	if err := room.recordParticipant(c.Request().Context(), user); err != nil {
+		c.Logger().Error(err)
+	}
 
 	resp := &TokenResponse{
 		Url:   mainConfig.Livekit.URL.String(),
@@ -399,6 +602,17 @@ func joinRoomHandler(c echo.Context) (err error) {
 		c.Logger().Error(err)
 	}
 
+	// Show the indicator on the user's Mastodon profile while on air
+	if canTalk && user.LiveAvatar {
+		go func(u *AudonUser, blue bool, logger echo.Logger) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := u.SetLiveAvatar(ctx, blue); err != nil {
+				logger.Error(err)
+			}
+		}(user, room.IsHost(user) || room.IsCoHost(user), c.Logger())
+	}
+
 	// Update room metadata
 	roomMetadata.MastodonAccounts[user.AudonID] = mastoAccount
 	newMetadata, err := json.Marshal(roomMetadata)
@@ -456,10 +670,80 @@ func closeRoomHandler(c echo.Context) error {
 		c.Logger().Error(err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
+	if err := room.logModeration(c.Request().Context(), user, "close", nil, ""); err != nil {
+		c.Logger().Error(err)
+	}
 
 	return c.NoContent(http.StatusOK)
 }
 
+// handler for POST to /api/room/:id/resume
+// The host reopens the ended room with the same ID and settings within the grace period.
+func resumeRoomHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	room, err := findRoomByID(c.Request().Context(), roomID)
+	if err == mongo.ErrNoDocuments {
+		return ErrRoomNotFound
+	} else if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	host := c.Get("user").(*AudonUser)
+	if !room.IsHost(host) {
+		return ErrOperationNotPermitted
+	}
+	if room.EndedAt.IsZero() {
+		return echo.NewHTTPError(http.StatusConflict, "not_ended")
+	}
+	if !room.IsResumable() || (!room.EndsAt.IsZero() && room.EndsAt.Before(time.Now())) {
+		return ErrAlreadyEnded
+	}
+	if err := checkNotHosting(c, host); err != nil {
+		return err
+	}
+	// the token may have been revoked while the room was closed
+	if err := storeHostCredential(c, room); err != nil {
+		return err
+	}
+
+	// make sure that the room is resumed only once
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	result, err := coll.UpdateOne(c.Request().Context(),
+		bson.D{
+			{Key: "room_id", Value: roomID},
+			{Key: "resumable_until", Value: bson.D{{Key: "$gt", Value: time.Now().UTC()}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "ended_at", Value: time.Time{}},
+			{Key: "resumable_until", Value: time.Time{}},
+			{Key: "succession_at", Value: time.Time{}},
+		}}})
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if result.ModifiedCount == 0 {
+		return ErrAlreadyEnded
+	}
+	room.EndedAt = time.Time{}
+	room.ResumableUntil = time.Time{}
+
+	if err := startLivekitRoom(c.Request().Context(), room, c.Logger()); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusConflict)
+	}
+	if err := room.logModeration(c.Request().Context(), host, "resume", nil, ""); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.String(http.StatusOK, room.RoomID)
+}
+
 // Client notifies server that user left room
 func leaveRoomHandler(c echo.Context) error {
 	user := c.Get("user").(*AudonUser)
@@ -470,6 +754,10 @@ func leaveRoomHandler(c echo.Context) error {
 	} else if still {
 		return c.NoContent(http.StatusConflict)
 	}
+	// the user has left anyway, failing to restore the avatar shouldn't be an error
+	if err := user.RestoreAvatar(c.Request().Context()); err != nil {
+		c.Logger().Error(err)
+	}
 	if err := user.ClearUserAvatar(c.Request().Context()); err != nil {
 		c.Logger().Error(err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
@@ -507,11 +795,39 @@ func updateRoleHandler(c echo.Context) error {
 	if !lkRoomMetadata.IsUserInLivekitRoom(c.Request().Context(), audonID) {
 		return ErrUserNotFound
 	}
+	// guests are not registered, they can only be removed
+	if isGuestIdentity(audonID) {
+		if operation != "kick" {
+			return ErrOperationNotPermitted
+		}
+		// recorded so that the guest cannot refresh the token nor rejoin with the old one
+		guest := &AudonUser{AudonID: audonID}
+		lkRoomMetadata.Kicked = append(lkRoomMetadata.Kicked, guest)
+		if err := updateRoomMetadata(c.Request().Context(), lkRoomMetadata); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if _, err := lkRoomServiceClient.RemoveParticipant(c.Request().Context(), &livekit.RoomParticipantIdentity{
+			Room:     roomID,
+			Identity: audonID,
+		}); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if err := lkRoomMetadata.logModeration(c.Request().Context(), iam, operation, guest, ""); err != nil {
+			c.Logger().Error(err)
+		}
+		return c.NoContent(http.StatusOK)
+	}
 	tgtUser, err := findUserByID(c.Request().Context(), audonID)
 	if err != nil {
 		return ErrUserNotFound
 	}
-	if lkRoomMetadata.IsHost(tgtUser) || lkRoomMetadata.IsCoHost(tgtUser) {
+	if lkRoomMetadata.IsHost(tgtUser) {
+		return ErrOperationNotPermitted
+	}
+	// only the host can remove cohosts or hand the room over to them
+	if lkRoomMetadata.IsCoHost(tgtUser) && !(lkRoomMetadata.IsHost(iam) && (operation == "uncohost" || operation == "demote" || operation == "transfer" || operation == "mute")) {
 		return ErrOperationNotPermitted
 	}
 
@@ -527,68 +843,287 @@ func updateRoleHandler(c echo.Context) error {
 				return echo.NewHTTPError(http.StatusConflict, "already_speaking")
 			}
 		}
+		if limit := lkRoomMetadata.SpeakerLimit(); limit > 0 && len(lkRoomMetadata.Speakers) >= limit {
+			return ErrSpeakersFull
+		}
 		lkRoomMetadata.Speakers = append(lkRoomMetadata.Speakers, tgtUser)
 	} else if operation == "cohost" {
-		lkRoomMetadata.CoHosts = append(lkRoomMetadata.CoHosts, tgtUser)
-		coll := mainDB.Collection(COLLECTION_ROOM)
-		if _, err = coll.UpdateOne(c.Request().Context(),
-			bson.D{{Key: "room_id", Value: roomID}},
-			bson.D{{Key: "$set", Value: bson.D{{
-				Key:   "cohosts",
-				Value: lkRoomMetadata.CoHosts,
-			}}}}); err != nil {
+		// the user becomes a cohost after accepting the invitation
+		if lkRoomMetadata.IsPendingCoHost(tgtUser) {
+			return echo.NewHTTPError(http.StatusConflict, "already_invited")
+		}
+		lkRoomMetadata.PendingCoHosts = append(lkRoomMetadata.PendingCoHosts, tgtUser)
+		if err = lkRoomMetadata.storeCoHosts(c.Request().Context()); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		newPermission.CanPublish = lkRoomMetadata.IsSpeaker(tgtUser)
+	} else if operation == "uncohost" {
+		// the former cohost keeps speaking
+		if !lkRoomMetadata.IsCoHost(tgtUser) {
+			return ErrOperationNotPermitted
+		}
+		// the host should demote the cohost instead if speakers are full
+		if limit := lkRoomMetadata.SpeakerLimit(); limit > 0 && len(lkRoomMetadata.Speakers) >= limit {
+			return ErrSpeakersFull
+		}
+		lkRoomMetadata.CoHosts = excludeUser(lkRoomMetadata.CoHosts, tgtUser)
+		lkRoomMetadata.Speakers = append(lkRoomMetadata.Speakers, tgtUser)
+		if err = lkRoomMetadata.storeCoHosts(c.Request().Context()); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	} else if operation == "mute" {
+		muted, err := muteMicrophone(c.Request().Context(), roomID, tgtUser.AudonID)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if !muted {
+			return echo.NewHTTPError(http.StatusConflict, "already_muted")
+		}
+		lkRoomMetadata.recordMute(tgtUser, iam)
+	} else if operation == "transfer" {
+		if !lkRoomMetadata.IsCoHost(tgtUser) {
+			return ErrOperationNotPermitted
+		}
+		if err = lkRoomMetadata.transferHost(c.Request().Context(), tgtUser); err != nil {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusInternalServerError)
 		}
-	} else if operation == "kick" {
+	} else if operation == "kick" || operation == "ban" {
+		if operation == "ban" {
+			// also keep the user out of every future room of the host
+			ban := &HostBan{
+				HostID:    lkRoomMetadata.Host.AudonID,
+				Webfinger: tgtUser.Webfinger,
+				AddedBy:   iam.AudonID,
+				RoomID:    roomID,
+			}
+			if err := insertBan(c.Request().Context(), ban); err != nil && !mongo.IsDuplicateKeyError(err) {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+		}
 		lkRoomMetadata.Kicked = append(lkRoomMetadata.Kicked, tgtUser)
-		lkRoomServiceClient.RemoveParticipant(c.Request().Context(), &livekit.RoomParticipantIdentity{
-			Room:     roomID,
-			Identity: tgtUser.AudonID,
-		})
 	} else if operation == "demote" {
 		newPermission.CanPublish = false
+		if lkRoomMetadata.IsCoHost(tgtUser) {
+			lkRoomMetadata.CoHosts = excludeUser(lkRoomMetadata.CoHosts, tgtUser)
+			if err = lkRoomMetadata.storeCoHosts(c.Request().Context()); err != nil {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+		}
 	} else {
 		return ErrInvalidRequestFormat
 	}
 
-	if operation == "demote" || operation == "cohost" {
-		newSpeakers := make([]*AudonUser, 0, len(lkRoomMetadata.Speakers))
-		for _, v := range lkRoomMetadata.Speakers {
-			if v.AudonID != tgtUser.AudonID {
-				newSpeakers = append(newSpeakers, v)
+	if operation == "demote" {
+		lkRoomMetadata.Speakers = excludeUser(lkRoomMetadata.Speakers, tgtUser)
+	}
+
+	if operation != "kick" && operation != "ban" && operation != "mute" {
+		_, err = lkRoomServiceClient.UpdateParticipant(c.Request().Context(), &livekit.UpdateParticipantRequest{
+			Room:       roomID,
+			Identity:   audonID,
+			Permission: newPermission,
+		})
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	// transferHost has updated the metadata
+	if operation != "transfer" {
+		if err := updateRoomMetadata(c.Request().Context(), lkRoomMetadata); err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	// remove the user only after the kick is recorded so that they cannot rejoin in between
+	if operation == "kick" || operation == "ban" {
+		_, err := lkRoomServiceClient.RemoveParticipant(c.Request().Context(), &livekit.RoomParticipantIdentity{
+			Room:     roomID,
+			Identity: tgtUser.AudonID,
+		})
+		if err != nil {
+			// the user may have already left the room
+			if terr, ok := err.(twirp.Error); !ok || terr.Code() != twirp.NotFound {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
 			}
 		}
-		lkRoomMetadata.Speakers = newSpeakers
 	}
 
-	newMetadata, err := json.Marshal(lkRoomMetadata)
+	if err := lkRoomMetadata.logModeration(c.Request().Context(), iam, operation, tgtUser, ""); err != nil {
+		c.Logger().Error(err)
+	}
+
+	if tgtUser.LiveAvatar {
+		go func(u *AudonUser, op string, logger echo.Logger) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var err error
+			if op == "speaker" || op == "uncohost" {
+				err = u.SetLiveAvatar(ctx, false)
+			} else if op == "demote" {
+				err = u.RestoreAvatar(ctx)
+			}
+			if err != nil {
+				logger.Error(err)
+			}
+		}(tgtUser, operation, c.Logger())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// handler for POST to /api/room/:id/token/refresh
+// Issues a new short-lived token after checking again that the user is still allowed to join.
+func refreshRoomTokenHandler(c echo.Context) error {
+	roomID := c.Param("id")
+	if err := mainValidator.Var(&roomID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	user := c.Get("user").(*AudonUser)
+
+	room, err := findRoomByID(c.Request().Context(), roomID)
+	if err != nil {
+		return ErrRoomNotFound
+	}
+	if !room.EndedAt.IsZero() && room.EndedAt.Before(time.Now()) {
+		return ErrAlreadyEnded
+	}
+
+	lkRoom, _ := getRoomInLivekit(c.Request().Context(), roomID)
+	if lkRoom == nil {
+		return ErrRoomNotFound
+	}
+	roomMetadata, err := getRoomMetadataFromLivekitRoom(lkRoom)
 	if err != nil {
 		c.Logger().Error(err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	if operation != "kick" {
-		_, err = lkRoomServiceClient.UpdateParticipant(c.Request().Context(), &livekit.UpdateParticipantRequest{
-			Room:       roomID,
-			Identity:   audonID,
-			Permission: newPermission,
-		})
-		if err != nil {
+	// the account may have been suspended or the token revoked since joining
+	valid, acc, _ := verifyTokenInSession(c)
+	if !valid {
+		return ErrAccountUnavailable
+	}
+
+	if roomMetadata.IsKicked(user) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	// cohosts may have changed while the room is live, so check them in the metadata
+	canTalk := roomMetadata.IsHost(user) || roomMetadata.IsCoHost(user)
+	if !canTalk {
+		if denied, err := isDeniedByHost(c.Request().Context(), roomMetadata.Room, user); err != nil {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusInternalServerError)
+		} else if denied {
+			return ErrBannedByHost
+		}
+		invited := roomMetadata.IsInvited(user)
+		if !invited {
+			if invited, err = user.HasRedeemedInvite(c.Request().Context(), roomID); err != nil {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
 		}
+		// users waiting in the lobby cannot get a token until admitted
+		if roomMetadata.IsPending(user) && !roomMetadata.IsInvited(user) {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+		if !invited {
+			if err := checkJoinRestriction(c, roomMetadata.Room); err != nil {
+				return respondJoinError(c, err)
+			}
+			if filter := roomMetadata.EffectiveJoinFilter(); filter != nil && !roomMetadata.IsExemptFromJoinFilter(user) && !filter.Passes(acc) {
+				return ErrJoinFiltered
+			}
+		}
+	}
+	if roomMetadata.IsSpeaker(user) {
+		canTalk = true
 	}
 
-	metadataRequest := &livekit.UpdateRoomMetadataRequest{Room: roomID, Metadata: string(newMetadata)}
+	// users reconnecting after leaving count as new listeners
+	if limit := roomMetadata.ListenerLimit(); !canTalk && limit > 0 && !roomMetadata.IsUserInLivekitRoom(c.Request().Context(), user.AudonID) {
+		count, err := roomMetadata.CountListeners(c.Request().Context())
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		if count >= limit {
+			return ErrRoomFull
+		}
+	}
 
-	_, err = lkRoomServiceClient.UpdateRoomMetadata(context.Background(), metadataRequest)
+	token, err := getRoomToken(room, user, canTalk)
 	if err != nil {
 		c.Logger().Error(err)
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 
-	return c.NoContent(http.StatusOK)
+	return c.JSON(http.StatusOK, &TokenResponse{
+		Url:   mainConfig.Livekit.URL.String(),
+		Token: token,
+		Audon: user,
+	})
+}
+
+// Checks if the user in the session satisfies the join restriction of the room.
+// Host and cohosts should be excluded by the caller.
+func checkJoinRestriction(c echo.Context, room *Room) error {
+	if room.IsPrivate() {
+		return &RestrictionError{Restriction: room.Restriction}
+	}
+	if room.IsListOnly() {
+		user, _ := c.Get("user").(*AudonUser)
+		if !isInRoomList(room, user) {
+			return &RestrictionError{Restriction: room.Restriction}
+		}
+		return nil
+	}
+	if room.IsFollowingOnly() || room.IsFollowerOnly() || room.IsFollowingOrFollowerOnly() || room.IsMutualOnly() {
+		rel, err := getRelationshipWithHost(c, room)
+		if err != nil {
+			return err
+		}
+		if (room.IsFollowingOnly() && !rel.FollowedBy) ||
+			(room.IsFollowerOnly() && !rel.Following) ||
+			(room.IsFollowingOrFollowerOnly() && !(rel.FollowedBy || rel.Following)) ||
+			(room.IsMutualOnly() && !(rel.FollowedBy && rel.Following)) {
+			return &RestrictionError{Restriction: room.Restriction}
+		}
+	}
+
+	return nil
+}
+
+// Restriction errors are sent as plain text so that the client can show the reason
+func respondJoinError(c echo.Context, err error) error {
+	if restErr, ok := err.(*RestrictionError); ok {
+		return c.String(http.StatusForbidden, restErr.Error())
+	}
+	return err
+}
+
+// if invitees are already registered, retrieve their data from DB
+func resolveInvitees(ctx context.Context, invitees []*AudonUser) {
+	for i, invitee := range invitees {
+		if invitee == nil {
+			continue
+		}
+		if inviteeUser, err := findUserByWebfinger(ctx, invitee.Webfinger); err == nil {
+			invitees[i] = inviteeUser
+		}
+	}
 }
 
 func getRoomToken(room *Room, user *AudonUser, canTalk bool) (string, error) {
@@ -603,11 +1138,70 @@ func getRoomToken(room *Room, user *AudonUser, canTalk bool) (string, error) {
 	}
 	metadata, _ := json.Marshal(user)
 
-	at.AddGrant(grant).SetIdentity(user.AudonID).SetValidFor(24 * time.Hour).SetMetadata(string(metadata))
+	at.AddGrant(grant).SetIdentity(user.AudonID).SetValidFor(ROOM_TOKEN_TTL).SetMetadata(string(metadata))
 
 	return at.ToJWT()
 }
 
+func updateRoomMetadata(ctx context.Context, meta *RoomMetadata) error {
+	newMetadata, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err = lkRoomServiceClient.UpdateRoomMetadata(ctx, &livekit.UpdateRoomMetadataRequest{
+		Room:     meta.RoomID,
+		Metadata: string(newMetadata),
+	}); err != nil {
+		return err
+	}
+
+	// kicked users are stored in DB too so that they are still kept out after the room is resumed
+	if len(meta.Kicked) == 0 {
+		return nil
+	}
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	_, err = coll.UpdateOne(ctx,
+		bson.D{{Key: "room_id", Value: meta.RoomID}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "kicked", Value: meta.Kicked}}}},
+	)
+	return err
+}
+
+// Sends data message to participants in the room.
+// If identities are given, only those participants receive the message.
+func sendRoomData(ctx context.Context, roomID string, data interface{}, identities ...string) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	req := &livekit.SendDataRequest{
+		Room: roomID,
+		Data: payload,
+		Kind: livekit.DataPacket_RELIABLE,
+	}
+	if len(identities) > 0 {
+		participantsInfo, err := lkRoomServiceClient.ListParticipants(ctx, &livekit.ListParticipantsRequest{Room: roomID})
+		if err != nil {
+			return err
+		}
+		for _, p := range participantsInfo.GetParticipants() {
+			for _, id := range identities {
+				if p.GetIdentity() == id {
+					req.DestinationSids = append(req.DestinationSids, p.GetSid())
+					break
+				}
+			}
+		}
+		if len(req.DestinationSids) == 0 {
+			return nil
+		}
+	}
+
+	_, err = lkRoomServiceClient.SendData(ctx, req)
+	return err
+}
+
 func getRoomInLivekit(ctx context.Context, roomID string) (*livekit.Room, bool) {
 	rooms, _ := lkRoomServiceClient.ListRooms(ctx, &livekit.ListRoomsRequest{Names: []string{roomID}})
 	if len(rooms.GetRooms()) == 0 {
@@ -641,15 +1235,25 @@ func endRoom(ctx context.Context, room *Room) error {
 
 	now := time.Now().UTC()
 
+	// the host can resume the room until the grace period passes
 	collRoom := mainDB.Collection(COLLECTION_ROOM)
 	if _, err := collRoom.UpdateOne(ctx,
 		bson.D{{Key: "room_id", Value: room.RoomID}},
 		bson.D{
-			{Key: "$set", Value: bson.D{{Key: "ended_at", Value: now}}},
+			{Key: "$set", Value: bson.D{
+				{Key: "ended_at", Value: now},
+				{Key: "resumable_until", Value: now.Add(mainConfig.Livekit.ResumeGracePeriod)},
+			}},
 		}); err != nil {
 		return err
 	}
 
+	if mainConfig.Bot.Enable {
+		if err := queueAnnouncementFollowUp(ctx, room.RoomID); err != nil {
+			log.Println(err)
+		}
+	}
+
 	rooms, err := lkRoomServiceClient.ListRooms(ctx, &livekit.ListRoomsRequest{Names: []string{room.RoomID}})
 	if err == nil && len(rooms.Rooms) != 0 {
 		_, err := lkRoomServiceClient.DeleteRoom(ctx, &livekit.DeleteRoomRequest{Room: room.RoomID})
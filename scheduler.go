@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type RoomEndWarning struct {
+	Kind    string    `json:"kind"`
+	Minutes int       `json:"minutes"`
+	EndsAt  time.Time `json:"ends_at"`
+}
+
+// Warnings are sent to participants this many minutes before the room ends
+var ROOM_END_WARNINGS = []int{1, 10}
+
+const SCHEDULER_INTERVAL = 15 * time.Second
+
+// Ends rooms at their EndsAt and sends warnings beforehand, and runs host successions.
+// The schedule is kept in DB, so rooms are still ended after the server restarts.
+func runRoomScheduler(ctx context.Context) {
+	ticker := time.NewTicker(SCHEDULER_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := processScheduledRooms(ctx); err != nil {
+			log.Println(err)
+		}
+		if err := processHostSuccessions(ctx); err != nil {
+			log.Println(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func processScheduledRooms(ctx context.Context) error {
+	maxWarning := time.Duration(ROOM_END_WARNINGS[len(ROOM_END_WARNINGS)-1]) * time.Minute
+
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	cur, err := coll.Find(ctx, bson.D{
+		{Key: "ended_at", Value: time.Time{}},
+		{Key: "ends_at", Value: bson.D{
+			{Key: "$gt", Value: time.Time{}},
+			{Key: "$lte", Value: time.Now().UTC().Add(maxWarning)},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	var rooms []*Room
+	if err := cur.All(ctx, &rooms); err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		remaining := time.Until(room.EndsAt)
+		if remaining <= 0 {
+			if err := endRoom(ctx, room); err != nil {
+				log.Println(err)
+				continue
+			}
+			if err := room.logModeration(ctx, nil, "scheduled_end", nil, ""); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		if err := room.sendEndWarning(ctx, remaining); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// Sends the nearest warning which has not been sent yet.
+// Warnings are marked as sent in DB first, so each is sent only once even with multiple servers.
+func (r *Room) sendEndWarning(ctx context.Context, remaining time.Duration) error {
+	due := []int{}
+	for _, minutes := range ROOM_END_WARNINGS {
+		if remaining <= time.Duration(minutes)*time.Minute {
+			due = append(due, minutes)
+		}
+	}
+	if len(due) == 0 {
+		return nil
+	}
+
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	result, err := coll.UpdateOne(ctx,
+		bson.D{
+			{Key: "room_id", Value: r.RoomID},
+			{Key: "end_warnings", Value: bson.D{{Key: "$ne", Value: due[0]}}},
+		},
+		bson.D{{Key: "$addToSet", Value: bson.D{{Key: "end_warnings", Value: bson.D{{Key: "$each", Value: due}}}}}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return nil
+	}
+
+	if _, exists := getRoomInLivekit(ctx, r.RoomID); !exists {
+		return nil
+	}
+	return sendRoomData(ctx, r.RoomID, &RoomEndWarning{
+		Kind:    "end_warning",
+		Minutes: due[0],
+		EndsAt:  r.EndsAt,
+	})
+}
+
+// Returns the end time limited by the maximum duration of this server
+func (r *Room) limitEndsAt(endsAt time.Time) time.Time {
+	if mainConfig.Limit.MaxDuration <= 0 {
+		return endsAt
+	}
+	limit := r.CreatedAt.Add(mainConfig.Limit.MaxDuration)
+	if endsAt.IsZero() || endsAt.After(limit) {
+		return limit
+	}
+	return endsAt
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/livekit/protocol/livekit"
@@ -17,6 +18,8 @@ type (
 		MastodonConfig *mastodon.Config
 		AuthCode       string
 		AudonID        string
+		LiveAvatar     bool
+		Software       string // see FediverseProvider
 	}
 
 	AudonUser struct {
@@ -25,26 +28,59 @@ type (
 		RemoteURL  string    `bson:"remote_url" json:"remote_url" validate:"url"`
 		Webfinger  string    `bson:"webfinger" json:"webfinger" validate:"email"`
 		AvatarFile string    `bson:"avatar" json:"avatar"`
+		LiveAvatar bool      `bson:"live_avatar" json:"live_avatar"`
 		CreatedAt  time.Time `bson:"created_at" json:"created_at"`
 	}
 
+	// Stored alongside the user document so that the server can call
+	// Mastodon API on behalf of the user without an active session.
+	// Only users enabling the live avatar store it.
+	UserCredential struct {
+		AudonID        string           `bson:"audon_id"`
+		MastodonConfig *mastodon.Config `bson:"mastodon"`
+		Software       string           `bson:"software"`
+	}
+
 	RoomMetadata struct {
 		*Room
 		Speakers         []*AudonUser                `json:"speakers"`
 		Kicked           []*AudonUser                `json:"kicked"`
+		Pending          []*AudonUser                `json:"pending"`
+		Admitted         []*AudonUser                `json:"admitted"`
 		MastodonAccounts map[string]*MastodonAccount `json:"accounts"`
+		MutedBy          map[string]string           `json:"muted_by"` // audon_id of the user muted -> who muted
 	}
 
 	Room struct {
-		RoomID      string          `bson:"room_id" json:"room_id" validate:"required,printascii"`
-		Title       string          `bson:"title" json:"title" validate:"required,max=100,printascii|multibyte"`
-		Description string          `bson:"description" json:"description" validate:"max=500,ascii|multibyte"`
-		Host        *AudonUser      `bson:"host" json:"host"`
-		CoHosts     []*AudonUser    `bson:"cohosts" json:"cohosts"`
-		Restriction JoinRestriction `bson:"restriction" json:"restriction"`
-		EndedAt     time.Time       `bson:"ended_at" json:"ended_at"`
-		CreatedAt   time.Time       `bson:"created_at" json:"created_at"`
-		Advertise   string          `bson:"advertise" json:"advertise"`
+		RoomID          string          `bson:"room_id" json:"room_id" validate:"required,printascii"`
+		Title           string          `bson:"title" json:"title" validate:"required,max=100,printascii|multibyte"`
+		Description     string          `bson:"description" json:"description" validate:"max=500,ascii|multibyte"`
+		Host            *AudonUser      `bson:"host" json:"host"`
+		CoHosts         []*AudonUser    `bson:"cohosts" json:"cohosts"`
+		PendingCoHosts  []*AudonUser    `bson:"pending_cohosts" json:"pending_cohosts"`
+		Restriction     JoinRestriction `bson:"restriction" json:"restriction"`
+		ListID          string          `bson:"list_id" json:"list_id" validate:"omitempty,printascii"` // Mastodon list of the host, used with LIST
+		EndedAt         time.Time       `bson:"ended_at" json:"ended_at"`
+		ResumableUntil  time.Time       `bson:"resumable_until" json:"resumable_until"`
+		EndsAt          time.Time       `bson:"ends_at" json:"ends_at"`
+		EndWarnings     []int           `bson:"end_warnings" json:"-"` // minutes of the warnings already sent
+		JoinFilter      *JoinFilter     `bson:"join_filter" json:"join_filter" validate:"omitempty"`
+		RaidMode        bool            `bson:"raid_mode" json:"raid_mode"`
+		CreatedAt       time.Time       `bson:"created_at" json:"created_at"`
+		Advertise       string          `bson:"advertise" json:"advertise"`
+		AnnouncementID  string          `bson:"announcement_id" json:"-"`  // status of the bot, set by the outbox after sent
+		AnnouncementBot string          `bson:"announcement_bot" json:"-"` // tag of the bot that posted AnnouncementID
+		AnnouncementKey string          `bson:"announcement_key" json:"-"` // key of the latest announcement in the outbox
+		DenyBlocked     bool            `bson:"deny_blocked" json:"deny_blocked"`
+		Invitees        []*AudonUser    `bson:"invitees" json:"invitees"`
+		AllowGuests     bool            `bson:"allow_guests" json:"allow_guests"`
+		Lobby           bool            `bson:"lobby" json:"lobby"`
+		MaxListeners    int             `bson:"max_listeners" json:"max_listeners" validate:"gte=0"`
+		MaxSpeakers     int             `bson:"max_speakers" json:"max_speakers" validate:"gte=0"`
+		Kicked          []*AudonUser    `bson:"kicked" json:"-"`                 // copy of RoomMetadata.Kicked, kept out when the room is resumed
+		Participants    []string        `bson:"participants,omitempty" json:"-"` // AudonIDs of the users who got a token, see recordParticipant
+		SuccessionAt    time.Time       `bson:"succession_at" json:"-"`          // when the longest-present cohost takes over, see scheduleHostSuccession
+		SuccessionFrom  string          `bson:"succession_from" json:"-"`        // AudonID of the host who left
 	}
 
 	TokenResponse struct {
@@ -53,14 +89,24 @@ type (
 		Audon     *AudonUser `json:"audon"`
 		Indicator string     `json:"indicator"`
 		Original  string     `json:"original"`
+		Guest     *GuestUser `json:"guest,omitempty"`
+		GuestKey  string     `json:"guest_key,omitempty"` // used by guests to refresh the token
+		Software  string     `json:"software,omitempty"`
 	}
 )
 
 type JoinRestriction string
 
 const (
-	COLLECTION_USER = "user"
-	COLLECTION_ROOM = "room"
+	COLLECTION_USER           = "user"
+	COLLECTION_ROOM           = "room"
+	COLLECTION_BAN            = "ban"
+	COLLECTION_INVITE         = "invite"
+	COLLECTION_MODERATION_LOG = "moderation_log"
+	COLLECTION_REPORT         = "report"
+	COLLECTION_AP_FOLLOWER    = "ap_follower"
+	COLLECTION_SUBSCRIPTION   = "subscription"
+	COLLECTION_OUTBOX         = "outbox"
 
 	EVERYONE              JoinRestriction = "everyone"
 	FOLLOWING             JoinRestriction = "following"
@@ -68,6 +114,7 @@ const (
 	FOLLOWING_OR_FOLLOWER JoinRestriction = "knowing"
 	MUTUAL                JoinRestriction = "mutual"
 	PRIVATE               JoinRestriction = "private"
+	LIST                  JoinRestriction = "list"
 )
 
 func (a *AudonUser) GetCurrentLivekitRooms(ctx context.Context) ([]*livekit.Room, error) {
@@ -114,6 +161,10 @@ func (r *Room) IsPrivate() bool {
 	return r.Restriction == PRIVATE
 }
 
+func (r *Room) IsListOnly() bool {
+	return r.Restriction == LIST
+}
+
 func (r *Room) IsCoHost(u *AudonUser) bool {
 	if r == nil {
 		return false
@@ -128,6 +179,43 @@ func (r *Room) IsCoHost(u *AudonUser) bool {
 	return false
 }
 
+func (r *Room) IsPendingCoHost(u *AudonUser) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, cohost := range r.PendingCoHosts {
+		if cohost.Equal(u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pending cohosts are also regarded as invited so that they can accept in the room
+func (r *Room) IsInvited(u *AudonUser) bool {
+	if r == nil {
+		return false
+	}
+	if r.IsPendingCoHost(u) {
+		return true
+	}
+
+	for _, invitee := range r.Invitees {
+		if invitee.Equal(u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the room has ended but is still in the grace period to be resumed
+func (r *Room) IsResumable() bool {
+	return r != nil && !r.EndedAt.IsZero() && r.ResumableUntil.After(time.Now())
+}
+
 func (r *Room) IsHost(u *AudonUser) bool {
 	return r != nil && r.Host.Equal(u)
 }
@@ -141,6 +229,82 @@ func (r *RoomMetadata) IsSpeaker(u *AudonUser) bool {
 	return false
 }
 
+func (r *RoomMetadata) IsKicked(u *AudonUser) bool {
+	for _, k := range r.Kicked {
+		if k.Equal(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the maximum number of listeners in effect, 0 means unlimited
+func (r *Room) ListenerLimit() int {
+	return effectiveLimit(r.MaxListeners, mainConfig.Limit.MaxListeners)
+}
+
+// Returns the maximum number of speakers in effect, 0 means unlimited
+func (r *Room) SpeakerLimit() int {
+	return effectiveLimit(r.MaxSpeakers, mainConfig.Limit.MaxSpeakers)
+}
+
+// Returns true if the host's token is needed to check who can join, see storeHostCredential
+func (r *Room) NeedsHostCredential() bool {
+	return r.DenyBlocked || r.Restriction == LIST
+}
+
+// Returns the cap passed to LiveKit as MaxParticipants, 0 means unlimited.
+// Host, cohosts and speakers are counted in, plus a margin for participants reconnecting with a new session.
+func (r *Room) ParticipantCap() uint32 {
+	maxListeners, maxSpeakers := r.ListenerLimit(), r.SpeakerLimit()
+	if maxListeners <= 0 || maxSpeakers <= 0 {
+		return 0
+	}
+	return uint32(maxListeners + maxSpeakers + len(r.CoHosts) + len(r.PendingCoHosts) + 1 + ROOM_PARTICIPANT_MARGIN)
+}
+
+func effectiveLimit(roomLimit, instanceLimit int) int {
+	if roomLimit <= 0 || (instanceLimit > 0 && instanceLimit < roomLimit) {
+		return instanceLimit
+	}
+	return roomLimit
+}
+
+// Counts participants in LiveKit other than host, cohosts and speakers, including guests
+func (r *RoomMetadata) CountListeners(ctx context.Context) (int, error) {
+	participantsInfo, err := lkRoomServiceClient.ListParticipants(ctx, &livekit.ListParticipantsRequest{Room: r.RoomID})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, p := range participantsInfo.GetParticipants() {
+		u := &AudonUser{AudonID: p.GetIdentity()}
+		if !r.IsHost(u) && !r.IsCoHost(u) && !r.IsSpeaker(u) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *RoomMetadata) IsPending(u *AudonUser) bool {
+	for _, p := range r.Pending {
+		if p.Equal(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RoomMetadata) IsAdmitted(u *AudonUser) bool {
+	for _, a := range r.Admitted {
+		if a.Equal(u) {
+			return true
+		}
+	}
+	return false
+}
+
 func getRoomMetadataFromLivekitRoom(lkRoom *livekit.Room) (*RoomMetadata, error) {
 	metadata := new(RoomMetadata)
 	if err := json.Unmarshal([]byte(lkRoom.GetMetadata()), metadata); err != nil {
@@ -220,7 +384,7 @@ func createIndexes(ctx context.Context) error {
 		return err
 	}
 
-	if len(roomIndexes) < 3 {
+	if len(roomIndexes) < 4 {
 		_, err := roomColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
 			{
 				Keys:    bson.D{{Key: "room_id", Value: 1}},
@@ -229,6 +393,151 @@ func createIndexes(ctx context.Context) error {
 			{
 				Keys: bson.D{{Key: "host.audon_id", Value: 1}},
 			},
+			{
+				Keys: bson.D{{Key: "ended_at", Value: 1}, {Key: "ends_at", Value: 1}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	banColl := mainDB.Collection(COLLECTION_BAN)
+	banIndexes, err := banColl.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(banIndexes) < 3 {
+		_, err := banColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "ban_id", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "host_id", Value: 1}, {Key: "webfinger", Value: 1}, {Key: "domain", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	inviteColl := mainDB.Collection(COLLECTION_INVITE)
+	inviteIndexes, err := inviteColl.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(inviteIndexes) < 3 {
+		_, err := inviteColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "invite_id", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{{Key: "room_id", Value: 1}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	logColl := mainDB.Collection(COLLECTION_MODERATION_LOG)
+	logIndexes, err := logColl.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(logIndexes) < 3 {
+		_, err := logColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "created_at", Value: -1}},
+			},
+			{
+				Keys: bson.D{{Key: "created_at", Value: -1}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	reportColl := mainDB.Collection(COLLECTION_REPORT)
+	reportIndexes, err := reportColl.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(reportIndexes) < 3 {
+		_, err := reportColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "report_id", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	followerColl := mainDB.Collection(COLLECTION_AP_FOLLOWER)
+	followerIndexes, err := followerColl.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(followerIndexes) < 2 {
+		_, err := followerColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "host_id", Value: 1}, {Key: "actor", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	subscriptionColl := mainDB.Collection(COLLECTION_SUBSCRIPTION)
+	subscriptionIndexes, err := subscriptionColl.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(subscriptionIndexes) < 3 {
+		_, err := subscriptionColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "subscriber_id", Value: 1}, {Key: "host_id", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{{Key: "host_id", Value: 1}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	outboxColl := mainDB.Collection(COLLECTION_OUTBOX)
+	outboxIndexes, err := outboxColl.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(outboxIndexes) < 3 {
+		_, err := outboxColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "key", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys: bson.D{{Key: "state", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+			},
 		})
 		if err != nil {
 			return err
@@ -264,3 +573,22 @@ func findUserByWebfinger(ctx context.Context, webfinger string) (*AudonUser, err
 	}
 	return &result, nil
 }
+
+func findUserCredential(ctx context.Context, audonID string) (*UserCredential, error) {
+	var result UserCredential
+	coll := mainDB.Collection(COLLECTION_USER)
+	opts := options.FindOne().SetProjection(bson.D{{Key: "audon_id", Value: 1}, {Key: "mastodon", Value: 1}, {Key: "software", Value: 1}})
+	if err := coll.FindOne(ctx, bson.D{{Key: "audon_id", Value: audonID}}, opts).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.MastodonConfig == nil || result.MastodonConfig.AccessToken == "" {
+		// only users enabling the live avatar store the token, others' token is available while they are logged in
+		if item := userSessionCache.Get(audonID); item != nil {
+			if data := item.Value(); data.MastodonConfig != nil && data.MastodonConfig.AccessToken != "" {
+				return &UserCredential{AudonID: audonID, MastodonConfig: data.MastodonConfig, Software: data.Software}, nil
+			}
+		}
+		return nil, errors.New("credential not stored")
+	}
+	return &result, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestRoomLimits(t *testing.T) {
+	defer func(conf *AppConfig) { mainConfig = conf }(mainConfig)
+
+	tests := []struct {
+		name          string
+		instance      RoomLimitConfig
+		room          *Room
+		wantListeners int
+		wantSpeakers  int
+		wantCap       uint32
+	}{
+		{"unlimited", RoomLimitConfig{}, &Room{}, 0, 0, 0},
+		{"room limits", RoomLimitConfig{}, &Room{MaxListeners: 50, MaxSpeakers: 5}, 50, 5, 50 + 5 + 1 + ROOM_PARTICIPANT_MARGIN},
+		{"instance limits", RoomLimitConfig{MaxListeners: 100, MaxSpeakers: 10}, &Room{}, 100, 10, 100 + 10 + 1 + ROOM_PARTICIPANT_MARGIN},
+		{"room limits under the instance ones", RoomLimitConfig{MaxListeners: 100, MaxSpeakers: 10}, &Room{MaxListeners: 20, MaxSpeakers: 2}, 20, 2, 20 + 2 + 1 + ROOM_PARTICIPANT_MARGIN},
+		{"room limits over the instance ones", RoomLimitConfig{MaxListeners: 100, MaxSpeakers: 10}, &Room{MaxListeners: 500, MaxSpeakers: 50}, 100, 10, 100 + 10 + 1 + ROOM_PARTICIPANT_MARGIN},
+		{"only listeners limited", RoomLimitConfig{}, &Room{MaxListeners: 50}, 50, 0, 0},
+		{
+			"cohosts counted in",
+			RoomLimitConfig{},
+			&Room{MaxListeners: 50, MaxSpeakers: 5, CoHosts: []*AudonUser{{AudonID: "a"}}, PendingCoHosts: []*AudonUser{{AudonID: "b"}}},
+			50, 5, 50 + 5 + 1 + 2 + ROOM_PARTICIPANT_MARGIN,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := tt.instance
+			mainConfig = &AppConfig{Limit: &limit}
+			if got := tt.room.ListenerLimit(); got != tt.wantListeners {
+				t.Errorf("ListenerLimit() = %d, want %d", got, tt.wantListeners)
+			}
+			if got := tt.room.SpeakerLimit(); got != tt.wantSpeakers {
+				t.Errorf("SpeakerLimit() = %d, want %d", got, tt.wantSpeakers)
+			}
+			if got := tt.room.ParticipantCap(); got != tt.wantCap {
+				t.Errorf("ParticipantCap() = %d, want %d", got, tt.wantCap)
+			}
+		})
+	}
+}
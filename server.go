@@ -56,6 +56,15 @@ var (
 	userSessionCache    *ttlcache.Cache[string, *SessionData]
 	webhookTimerCache   *ttlcache.Cache[string, *time.Timer]
 	orphanRooms         *ttlcache.Cache[string, bool]
+	hostBlockCache      *ttlcache.Cache[string, *HostBlockList]
+	hostBlockStaleCache *ttlcache.Cache[string, *HostBlockList] // the last lists loaded, used while they cannot be fetched
+	hostListCache       *ttlcache.Cache[string, HostListMembers]
+	relationshipCache   *ttlcache.Cache[string, *mastodon.Relationship]
+	guestRateCache      *ttlcache.Cache[string, int]
+	guestKeyCache       *ttlcache.Cache[string, *GuestUser]
+	reportRateCache     *ttlcache.Cache[string, int]
+	// Hosts whose subscribers have been notified recently
+	subscriptionCooldownCache *ttlcache.Cache[string, bool]
 )
 
 func init() {
@@ -104,6 +113,23 @@ func main() {
 		log.Fatalf("Failed creating indexes: %s\n", err.Error())
 	}
 
+	// Restore avatars of users who left while the server was down
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if err := restoreStaleAvatars(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	// Close rooms at their scheduled end
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	go runRoomScheduler(schedulerCtx)
+
+	// Send queued posts of the bot
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	go runOutbox(outboxCtx)
+
 	// Setup redis client
 	redisClient := redis.NewClient(&redis.Options{
 		Addr:     mainConfig.Redis.Host,
@@ -158,9 +184,43 @@ func main() {
 	userSessionCache = ttlcache.New(ttlcache.WithTTL[string, *SessionData](168 * time.Hour))
 	webhookTimerCache = ttlcache.New(ttlcache.WithTTL[string, *time.Timer](5 * time.Minute))
 	orphanRooms = ttlcache.New(ttlcache.WithTTL[string, bool](24 * time.Hour))
+	hostBlockCache = ttlcache.New(
+		ttlcache.WithTTL[string, *HostBlockList](10*time.Minute),
+		ttlcache.WithLoader[string, *HostBlockList](ttlcache.LoaderFunc[string, *HostBlockList](loadHostBlockList)),
+	)
+	hostBlockStaleCache = ttlcache.New(
+		ttlcache.WithTTL[string, *HostBlockList](24*time.Hour),
+		ttlcache.WithDisableTouchOnHit[string, *HostBlockList](),
+	)
+	hostListCache = ttlcache.New(
+		ttlcache.WithTTL[string, HostListMembers](10*time.Minute),
+		ttlcache.WithLoader[string, HostListMembers](ttlcache.LoaderFunc[string, HostListMembers](loadHostListMembers)),
+	)
+	relationshipCache = ttlcache.New(ttlcache.WithTTL[string, *mastodon.Relationship](5 * time.Minute))
+	guestRateCache = ttlcache.New(
+		ttlcache.WithTTL[string, int](mainConfig.Guest.RateWindow),
+		ttlcache.WithDisableTouchOnHit[string, int](),
+	)
 	go userSessionCache.Start()
 	go webhookTimerCache.Start()
 	go orphanRooms.Start()
+	go hostBlockCache.Start()
+	go hostBlockStaleCache.Start()
+	go hostListCache.Start()
+	go relationshipCache.Start()
+	subscriptionCooldownCache = ttlcache.New(
+		ttlcache.WithTTL[string, bool](SUBSCRIPTION_COOLDOWN),
+		ttlcache.WithDisableTouchOnHit[string, bool](),
+	)
+	reportRateCache = ttlcache.New(
+		ttlcache.WithTTL[string, int](REPORT_RATE_WINDOW),
+		ttlcache.WithDisableTouchOnHit[string, int](),
+	)
+	guestKeyCache = ttlcache.New(ttlcache.WithTTL[string, *GuestUser](GUEST_KEY_TTL))
+	go guestRateCache.Start()
+	go guestKeyCache.Start()
+	go reportRateCache.Start()
+	go subscriptionCooldownCache.Start()
 
 	e.POST("/app/login", loginHandler)
 	e.GET("/app/oauth", oauthHandler)
@@ -168,9 +228,24 @@ func main() {
 	e.POST("/app/logout", logoutHandler)
 	e.GET("/app/preview/:id", previewRoomHandler)
 	e.GET("/app/user/:id", getUserHandler)
+	e.POST("/app/room/:id/guest", guestJoinHandler)
+	e.POST("/app/room/:id/guest/refresh", refreshGuestTokenHandler)
 
 	e.POST("/app/webhook", livekitWebhookHandler)
 
+	e.GET("/.well-known/nodeinfo", nodeInfoLinksHandler)
+	e.GET("/.well-known/webfinger", webFingerHandler)
+	e.GET("/nodeinfo/:version", nodeInfoHandler)
+	e.GET("/ap/users/:name", getActorHandler)
+	e.POST("/ap/users/:name/inbox", postInboxHandler)
+	e.GET("/ap/users/:name/outbox", getOutboxHandler)
+	e.GET("/ap/users/:name/followers", getFollowersHandler)
+	e.GET("/ap/notes/:id", getNoteHandler)
+	if mainConfig.Environment == "development" {
+		e.POST("/ap/test/inbox", testInboxHandler)
+		e.POST("/ap/test/users/:name/follow", testFollowHandler)
+	}
+
 	api := e.Group("/api", authMiddleware)
 	api.GET("/token", getUserTokenHandler)
 	api.GET("/room", getStatusHandler)
@@ -180,6 +255,31 @@ func main() {
 	api.PATCH("/room/:id", updateRoomHandler)
 	api.DELETE("/room/:id", closeRoomHandler)
 	api.PUT("/room/:id", updateRoleHandler)
+	api.POST("/room/:id/token/refresh", refreshRoomTokenHandler)
+	api.GET("/room/:id/lobby", waitLobbyHandler)
+	api.PUT("/room/:id/lobby", updateLobbyHandler)
+	api.POST("/room/:id/resume", resumeRoomHandler)
+	api.PUT("/room/:id/mute", muteAllHandler)
+	api.PUT("/room/:id/raid", updateRaidModeHandler)
+	api.POST("/room/:id/cohost", acceptCoHostHandler)
+	api.DELETE("/room/:id/cohost", leaveCoHostHandler)
+	api.GET("/room/:id/invite", listInvitesHandler)
+	api.POST("/room/:id/invite", createInviteHandler)
+	api.DELETE("/room/:id/invite/:invite", revokeInviteHandler)
+	api.GET("/room/:id/log", listRoomModerationLogHandler)
+	api.GET("/log", listModerationLogHandler)
+	api.POST("/report", createReportHandler)
+	api.GET("/report", listReportsHandler)
+	api.PUT("/report/:id", updateReportHandler)
+	api.GET("/lists", getMastodonListsHandler)
+	api.GET("/subscription", listSubscriptionsHandler)
+	api.GET("/announcement", getAnnouncementConfigHandler)
+	api.PUT("/announcement", updateAnnouncementConfigHandler)
+	api.POST("/user/:id/subscribe", subscribeHandler)
+	api.DELETE("/user/:id/subscribe", unsubscribeHandler)
+	api.GET("/ban", listBansHandler)
+	api.POST("/ban", addBanHandler)
+	api.DELETE("/ban/:id", removeBanHandler)
 
 	e.Static("/assets", "audon-fe/dist/assets")
 	e.Static("/static", "audon-fe/dist/static")
@@ -209,6 +309,12 @@ func main() {
 	userSessionCache.DeleteAll()
 	webhookTimerCache.DeleteAll()
 	orphanRooms.DeleteAll()
+	hostBlockCache.DeleteAll()
+	hostBlockStaleCache.DeleteAll()
+	guestRateCache.DeleteAll()
+	guestKeyCache.DeleteAll()
+	stopScheduler()
+	stopOutbox()
 	if err := e.Shutdown(shutdownCtx); err != nil {
 		e.Logger.Fatalf("Failed shutting down gracefully: %s\n", err.Error())
 	}
@@ -225,7 +331,7 @@ func (cv *CustomValidator) Validate(i interface{}) error {
 	return nil
 }
 
-func getAppConfig(server string) (*mastodon.AppConfig, error) {
+func getAppConfig(server string, liveAvatar bool) (*mastodon.AppConfig, error) {
 	redirectURI := "urn:ietf:wg:oauth:2.0:oob"
 	u := &url.URL{
 		Host:   mainConfig.LocalDomain,
@@ -236,12 +342,15 @@ func getAppConfig(server string) (*mastodon.AppConfig, error) {
 	redirectURI = u.String()
 
 	conf := &mastodon.AppConfig{
-		ClientName: "Audon",
-		// Scopes:       "read:accounts read:follows write:accounts",
-		Scopes:       "read:accounts read:follows",
+		ClientName:   "Audon",
+		Scopes:       "read:accounts read:follows read:blocks read:mutes read:lists",
 		Website:      "https://codeberg.org/nmkj/audon",
 		RedirectURIs: redirectURI,
 	}
+	// write:accounts is requested only if the user opted in to the live avatar
+	if liveAvatar {
+		conf.Scopes += " write:accounts"
+	}
 
 	// mastAppConfigBase = conf
 
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A user who wants to be notified when the host starts a room
+type Subscription struct {
+	SubscriberID string     `bson:"subscriber_id" json:"-"`
+	Subscriber   string     `bson:"subscriber" json:"-"`
+	HostID       string     `bson:"host_id" json:"-"`
+	Host         *AudonUser `bson:"host" json:"host"`
+	CreatedAt    time.Time  `bson:"created_at" json:"created_at"`
+}
+
+const (
+	// Subscribers are mentioned in batches, not to exceed the character limit of a status
+	SUBSCRIPTION_MENTIONS_PER_STATUS = 5
+	// Rooms started again within this period don't notify subscribers again
+	SUBSCRIPTION_COOLDOWN = 30 * time.Minute
+)
+
+// handler for GET to /api/subscription
+func listSubscriptionsHandler(c echo.Context) error {
+	user := c.Get("user").(*AudonUser)
+
+	coll := mainDB.Collection(COLLECTION_SUBSCRIPTION)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cur, err := coll.Find(c.Request().Context(), bson.D{{Key: "subscriber_id", Value: user.AudonID}}, opts)
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	subscriptions := []*Subscription{}
+	if err := cur.All(c.Request().Context(), &subscriptions); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, subscriptions)
+}
+
+// handler for POST to /api/user/:id/subscribe
+func subscribeHandler(c echo.Context) error {
+	hostID := c.Param("id")
+	if err := mainValidator.Var(&hostID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	user := c.Get("user").(*AudonUser)
+	if user.AudonID == hostID {
+		return ErrOperationNotPermitted
+	}
+	host, err := findUserByID(c.Request().Context(), hostID)
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	coll := mainDB.Collection(COLLECTION_SUBSCRIPTION)
+	subscription := &Subscription{
+		SubscriberID: user.AudonID,
+		Subscriber:   user.Webfinger,
+		HostID:       host.AudonID,
+		Host:         host,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if _, err := coll.InsertOne(c.Request().Context(), subscription); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.NoContent(http.StatusNoContent)
+		}
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// handler for DELETE to /api/user/:id/subscribe
+func unsubscribeHandler(c echo.Context) error {
+	hostID := c.Param("id")
+	if err := mainValidator.Var(&hostID, "required,printascii"); err != nil {
+		return wrapValidationError(err)
+	}
+
+	user := c.Get("user").(*AudonUser)
+	coll := mainDB.Collection(COLLECTION_SUBSCRIPTION)
+	if _, err := coll.DeleteOne(c.Request().Context(), bson.D{
+		{Key: "subscriber_id", Value: user.AudonID},
+		{Key: "host_id", Value: hostID},
+	}); err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// Mentions the subscribers of the host from the bot account in direct messages.
+// The outbox sends them at its own pace, not to hit the rate limit.
+func notifySubscribers(ctx context.Context, room *Room, startedAt int64) error {
+	if item := subscriptionCooldownCache.Get(room.Host.AudonID); item != nil {
+		return nil
+	}
+
+	coll := mainDB.Collection(COLLECTION_SUBSCRIPTION)
+	cur, err := coll.Find(ctx, bson.D{{Key: "host_id", Value: room.Host.AudonID}})
+	if err != nil {
+		return err
+	}
+	var subscriptions []*Subscription
+	if err := cur.All(ctx, &subscriptions); err != nil {
+		return err
+	}
+	// users kept out of the host's rooms are not notified
+	recipients := make([]*Subscription, 0, len(subscriptions))
+	for _, s := range subscriptions {
+		denied, err := isDeniedByHost(ctx, room, &AudonUser{AudonID: s.SubscriberID, Webfinger: s.Subscriber})
+		if err != nil {
+			return err
+		}
+		if !denied {
+			recipients = append(recipients, s)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	localizer := i18n.NewLocalizer(localeBundle, room.Advertise)
+	header := localizer.MustLocalize(&i18n.LocalizeConfig{
+		DefaultMessage: &i18n.Message{
+			ID:    "SubscriptionNotification",
+			Other: "@{{.Host}} is live now!",
+		},
+		TemplateData: map[string]string{
+			"Host": room.Host.Webfinger,
+		},
+	})
+	// only the subscribers are mentioned
+	header = escapeMentions(header)
+	body := fmt.Sprintf(":udon: %s\n🎙️ https://%s/r/%s", escapeMentions(room.Title), mainConfig.LocalDomain, room.RoomID)
+
+	for i := 0; i < len(recipients); i += SUBSCRIPTION_MENTIONS_PER_STATUS {
+		end := i + SUBSCRIPTION_MENTIONS_PER_STATUS
+		if end > len(recipients) {
+			end = len(recipients)
+		}
+		mentions := make([]string, 0, end-i)
+		for _, s := range recipients[i:end] {
+			mentions = append(mentions, "@"+s.Subscriber)
+		}
+
+		if err := enqueueBotPost(ctx, &OutboxPost{
+			Key:        outboxKey(room.RoomID, OUTBOX_SUBSCRIPTION, startedAt, i/SUBSCRIPTION_MENTIONS_PER_STATUS),
+			RoomID:     room.RoomID,
+			Kind:       OUTBOX_SUBSCRIPTION,
+			Bot:        mainConfig.Bot.AccountFor(room).Tag,
+			Status:     strings.Join([]string{strings.Join(mentions, " "), header, body}, "\n\n"),
+			Visibility: "direct",
+		}); err != nil {
+			return err
+		}
+	}
+
+	subscriptionCooldownCache.Set(room.Host.AudonID, true, ttlcache.DefaultTTL)
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -129,6 +130,65 @@ func (a *AudonUser) InLivekit(ctx context.Context) (bool, error) {
 	return len(rooms) > 0, nil
 }
 
+// Returns a Mastodon client authorized with the user's stored token
+func (a *AudonUser) GetMastodonClient(ctx context.Context) (*mastodon.Client, error) {
+	cred, err := findUserCredential(ctx, a.AudonID)
+	if err != nil {
+		return nil, err
+	}
+	if normalizeSoftware(cred.Software) != SOFTWARE_MASTODON {
+		return nil, errors.New("mastodon api not supported")
+	}
+	mastoClient := mastodon.NewClient(cred.MastodonConfig)
+	mastoClient.UserAgent = USER_AGENT
+
+	return mastoClient, nil
+}
+
+// Stores the token in the session so that the server can act for the user while they are offline,
+// e.g. to restore the live avatar or to fetch the blocks and lists that the user's rooms rely on
+func storeUserCredential(ctx context.Context, data *SessionData) error {
+	if data == nil || data.MastodonConfig == nil || data.MastodonConfig.AccessToken == "" {
+		return ErrCredentialUnavailable
+	}
+	coll := mainDB.Collection(COLLECTION_USER)
+	_, err := coll.UpdateOne(ctx,
+		bson.D{{Key: "audon_id", Value: data.AudonID}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "mastodon", Value: data.MastodonConfig},
+			{Key: "software", Value: data.Software},
+		}}})
+	return err
+}
+
+// Returns true if the user hosts a live or resumable room that needs the stored token
+func (a *AudonUser) HostsRoomNeedingCredential(ctx context.Context) (bool, error) {
+	coll := mainDB.Collection(COLLECTION_ROOM)
+	count, err := coll.CountDocuments(ctx, bson.D{
+		{Key: "host.audon_id", Value: a.AudonID},
+		{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "ended_at", Value: time.Time{}}},
+				bson.D{{Key: "resumable_until", Value: bson.D{{Key: "$gt", Value: time.Now().UTC()}}}},
+			}}},
+			bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "deny_blocked", Value: true}},
+				bson.D{{Key: "restriction", Value: LIST}},
+			}}},
+		}},
+	})
+	return count > 0, err
+}
+
+// Fetches the profile of the user with the stored token, regardless of the server software
+func (a *AudonUser) GetCurrentAccount(ctx context.Context) (*mastodon.Account, error) {
+	cred, err := findUserCredential(ctx, a.AudonID)
+	if err != nil {
+		return nil, err
+	}
+	return getProvider(cred.Software).GetCurrentAccount(ctx, cred.MastodonConfig)
+}
+
 func (a *AudonUser) ClearUserAvatar(ctx context.Context) error {
 	coll := mainDB.Collection(COLLECTION_USER)
 	_, err := coll.UpdateOne(ctx,
@@ -131,8 +131,99 @@ func updateAvatar(ctx context.Context, c *mastodon.Client, filename string) (*ma
 	return account, nil
 }
 
+// Returns the domains blocked by the current user.
+func getDomainBlocks(ctx context.Context, c *mastodon.Client) ([]string, error) {
+	u, err := url.Parse(c.Config.Server)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "/api/v1/domain_blocks")
+	u.RawQuery = url.Values{"limit": {"200"}}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.Config.AccessToken)
+	req.Header.Set("User-Agent", USER_AGENT)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed: %d", resp.StatusCode)
+	}
+
+	var domains []string
+	if err := json.NewDecoder(resp.Body).Decode(&domains); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// go-mastodon doesn't send the limit, which returns only the first 40 accounts.
+// limit=0 returns all accounts in the list without pagination.
+func getListAccounts(ctx context.Context, c *mastodon.Client, listID string) ([]*mastodon.Account, error) {
+	u, err := url.Parse(c.Config.Server)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "/api/v1/lists", url.PathEscape(listID), "accounts")
+	u.RawQuery = url.Values{"limit": {"0"}}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.Config.AccessToken)
+	req.Header.Set("User-Agent", USER_AGENT)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed: %d", resp.StatusCode)
+	}
+
+	var accounts []*mastodon.Account
+	if err := json.NewDecoder(resp.Body).Decode(&accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// Returns the webfinger of the account in the same form as AudonUser's
+func accountWebfinger(acc *mastodon.Account) string {
+	acctUrl, _ := url.Parse(acc.URL)
+	finger := strings.Split(acc.Username, "@")
+	if acctUrl == nil {
+		return finger[0]
+	}
+	return fmt.Sprintf("%s@%s", finger[0], acctUrl.Host)
+}
+
+// Inserts a zero-width space after each @ so that text from users doesn't mention anyone in posts of the bot
+func escapeMentions(text string) string {
+	return strings.ReplaceAll(text, "@", "@\u200B")
+}
+
+// Inserts a zero-width space in each URL scheme so that the links in text from users are not linked in posts of the bot
+func escapeLinks(text string) string {
+	return strings.ReplaceAll(text, "://", ":\u200B//")
+}
+
 func getMastodonClient(data *SessionData) *mastodon.Client {
-	if data == nil || data.MastodonConfig.AccessToken == "" {
+	if data == nil || data.MastodonConfig == nil || data.MastodonConfig.AccessToken == "" {
+		return nil
+	}
+	// Misskey and its forks don't support Mastodon API
+	if normalizeSoftware(data.Software) != SOFTWARE_MASTODON {
 		return nil
 	}
 	mastoClient := mastodon.NewClient(data.MastodonConfig)
@@ -140,3 +231,74 @@ func getMastodonClient(data *SessionData) *mastodon.Client {
 
 	return mastoClient
 }
+
+// Returns the client of the notification bot
+func newBotClient(account *BotAccount) *mastodon.Client {
+	botClient := mastodon.NewClient(&mastodon.Config{
+		Server:       account.Server.String(),
+		ClientID:     account.ClientID,
+		ClientSecret: account.ClientSecret,
+		AccessToken:  account.AccessToken,
+	})
+	botClient.UserAgent = USER_AGENT
+	botClient.Transport = &idempotencyTransport{base: http.DefaultTransport}
+
+	return botClient
+}
+
+// Returns the bot for the instance of the host, or for the language of the room,
+// e.g. the bot of "ja" for "ja-JP" unless a bot has "ja-JP".
+// Falls back to the default bot, make sure that the bot is enabled.
+func (b *BotConfig) AccountFor(room *Room) *BotAccount {
+	if room.Host != nil {
+		_, instance, _ := strings.Cut(room.Host.Webfinger, "@")
+		for _, account := range b.Accounts {
+			if account.servesInstance(instance) {
+				return account
+			}
+		}
+	}
+
+	lang := room.Advertise
+	for _, account := range b.Accounts {
+		if account.servesLanguage(lang) {
+			return account
+		}
+	}
+	if base, _, found := strings.Cut(lang, "-"); found {
+		for _, account := range b.Accounts {
+			if account.servesLanguage(base) {
+				return account
+			}
+		}
+	}
+	return b.Fallback
+}
+
+// Returns nil if the bot has been removed from the config
+func (b *BotConfig) AccountByTag(tag string) *BotAccount {
+	for _, account := range b.Accounts {
+		if account.Tag == tag {
+			return account
+		}
+	}
+	return nil
+}
+
+func (a *BotAccount) servesLanguage(lang string) bool {
+	for _, l := range a.Languages {
+		if strings.EqualFold(l, lang) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *BotAccount) servesInstance(instance string) bool {
+	for _, i := range a.Instances {
+		if strings.EqualFold(i, instance) {
+			return true
+		}
+	}
+	return false
+}
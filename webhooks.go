@@ -2,17 +2,14 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/livekit/protocol/auth"
+	"github.com/livekit/protocol/livekit"
 	"github.com/livekit/protocol/webhook"
-	mastodon "github.com/mattn/go-mastodon"
-	"github.com/nicksnyder/go-i18n/v2/i18n"
 )
 
 func livekitWebhookHandler(c echo.Context) error {
@@ -30,12 +27,38 @@ func livekitWebhookHandler(c echo.Context) error {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
-		if room.EndedAt.IsZero() {
+		// the host may have resumed the room in the meantime
+		if _, resumed := getRoomInLivekit(c.Request().Context(), lkRoom.GetName()); room.EndedAt.IsZero() && !resumed {
 			if err := endRoom(c.Request().Context(), room); err != nil {
 				c.Logger().Error(err)
 				return echo.NewHTTPError(http.StatusInternalServerError)
 			}
 		}
+	} else if isGuestIdentity(event.GetParticipant().GetIdentity()) {
+		// guests are not registered, only remove ones rejoining with an old token after kicked or guests disabled
+		if event.GetEvent() != webhook.EventParticipantJoined {
+			return c.NoContent(http.StatusOK)
+		}
+		lkRoom, _ := getRoomInLivekit(c.Request().Context(), event.GetRoom().GetName())
+		if lkRoom == nil {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		identity := event.GetParticipant().GetIdentity()
+		if !meta.AllowsGuests() || meta.IsGuestKicked(identity) {
+			if _, err := lkRoomServiceClient.RemoveParticipant(c.Request().Context(), &livekit.RoomParticipantIdentity{
+				Room:     lkRoom.GetName(),
+				Identity: identity,
+			}); err != nil {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+		}
+		return c.NoContent(http.StatusOK)
 	} else if event.GetEvent() == webhook.EventParticipantLeft {
 		audonID := event.GetParticipant().GetIdentity()
 		user, err := findUserByID(c.Request().Context(), audonID)
@@ -43,20 +66,72 @@ func livekitWebhookHandler(c echo.Context) error {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
+		if meta, err := getRoomMetadataFromLivekitRoom(event.GetRoom()); err == nil && meta.IsHost(user) {
+			if err := scheduleHostSuccession(c.Request().Context(), meta.RoomID, user.AudonID); err != nil {
+				c.Logger().Error(err)
+			}
+		}
 		still, err := user.InLivekit(c.Request().Context())
 		if !still && err == nil {
-			data := userSessionCache.Get(audonID)
-			if data == nil {
-				return echo.NewHTTPError(http.StatusGone)
-			}
+			// the stored token is used here, so this works even if the user's session has gone
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
 			nextUser, err := findUserByID(ctx, audonID)
 			if err != nil {
 				log.Println(err)
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
+			if err := nextUser.RestoreAvatar(ctx); err != nil {
+				// keep the original avatar file so that it can be restored on the next startup
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
 			}
 			nextUser.ClearUserAvatar(ctx)
 		}
+	} else if event.GetEvent() == webhook.EventParticipantJoined {
+		// Tokens issued before kicking or banning are still valid for a while, so remove such users as soon as they rejoin
+		lkRoom, _ := getRoomInLivekit(c.Request().Context(), event.GetRoom().GetName())
+		if lkRoom == nil {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		meta, err := getRoomMetadataFromLivekitRoom(lkRoom)
+		if err != nil {
+			c.Logger().Error(err)
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		user, err := findUserByID(c.Request().Context(), event.GetParticipant().GetIdentity())
+		if err != nil {
+			return c.NoContent(http.StatusOK)
+		}
+		if meta.IsHost(user) {
+			if err := cancelHostSuccession(c.Request().Context(), meta.RoomID); err != nil {
+				c.Logger().Error(err)
+			}
+			return c.NoContent(http.StatusOK)
+		}
+		if meta.IsCoHost(user) {
+			// the host may have left while no cohost was there
+			if !meta.IsUserInLivekitRoom(c.Request().Context(), meta.Host.AudonID) {
+				if err := scheduleHostSuccession(c.Request().Context(), meta.RoomID, meta.Host.AudonID); err != nil {
+					c.Logger().Error(err)
+				}
+			}
+			return c.NoContent(http.StatusOK)
+		}
+		denied, err := isDeniedByHost(c.Request().Context(), meta.Room, user)
+		if err != nil {
+			c.Logger().Error(err)
+		}
+		// users put in the lobby by raid mode may reconnect with their old token
+		if denied || meta.IsKicked(user) || (meta.IsPending(user) && !meta.IsInvited(user)) {
+			if _, err := lkRoomServiceClient.RemoveParticipant(c.Request().Context(), &livekit.RoomParticipantIdentity{
+				Room:     lkRoom.GetName(),
+				Identity: user.AudonID,
+			}); err != nil {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
+			}
+		}
 	} else if event.GetEvent() == webhook.EventRoomStarted {
 		// Have the bot advertise the room
 		room, err := findRoomByID(c.Request().Context(), event.GetRoom().GetName())
@@ -64,42 +139,26 @@ func livekitWebhookHandler(c echo.Context) error {
 			c.Logger().Error(err)
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
-		if err == nil && mainConfig.Bot.Enable && room.Advertise != "" && room.Restriction == EVERYONE {
-			botClient := mastodon.NewClient(&mastodon.Config{
-				Server:       mainConfig.Bot.Server.String(),
-				ClientID:     mainConfig.Bot.ClientID,
-				ClientSecret: mainConfig.Bot.ClientSecret,
-				AccessToken:  mainConfig.Bot.AccessToken,
-			})
-			botClient.UserAgent = USER_AGENT
-
-			localizer := i18n.NewLocalizer(localeBundle, room.Advertise)
-			header := localizer.MustLocalize(&i18n.LocalizeConfig{
-				DefaultMessage: &i18n.Message{
-					ID:    "Advertise",
-					Other: "@{{.Host}} is streaming now!",
-				},
-				TemplateData: map[string]string{
-					"Host": room.Host.Webfinger,
-				},
-			})
-
-			messages := []string{
-				header,
-				fmt.Sprintf(":udon: %s\n🎙️ https://%s/u/@%s", room.Title, mainConfig.LocalDomain, room.Host.Webfinger),
+		// Posts are queued once per LiveKit room, so LiveKit can safely retry this webhook on errors
+		startedAt := event.GetRoom().GetCreationTime()
+		if mainConfig.Bot.Enable && room.Advertise != "" && room.Restriction == EVERYONE {
+			if err := queueAnnouncement(c.Request().Context(), room, startedAt); err != nil {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
 			}
-			if room.Description != "" {
-				messages = append(messages, room.Description)
+		}
+		// Mention the subscribers of the host
+		if mainConfig.Bot.Enable && room.Restriction == EVERYONE {
+			if err := notifySubscribers(c.Request().Context(), room, startedAt); err != nil {
+				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
 			}
-			messages = append(messages, "#Audon")
-			message := strings.Join(messages, "\n\n")
-
-			if _, err := botClient.PostStatus(c.Request().Context(), &mastodon.Toot{
-				Status:     message,
-				Language:   room.Advertise,
-				Visibility: "public",
-			}); err != nil {
+		}
+		// Notify followers of the host's actor, who have subscribed to the host by following
+		if room.Restriction == EVERYONE {
+			if err := publishRoomStarted(c.Request().Context(), room, startedAt); err != nil {
 				c.Logger().Error(err)
+				return echo.NewHTTPError(http.StatusInternalServerError)
 			}
 		}
 	}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/livekit/protocol/livekit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	WellKnownLink struct {
+		Rel  string `json:"rel"`
+		Type string `json:"type,omitempty"`
+		Href string `json:"href"`
+	}
+
+	NodeInfoLinks struct {
+		Links []*WellKnownLink `json:"links"`
+	}
+
+	NodeInfo struct {
+		Version           string           `json:"version"`
+		Software          NodeInfoSoftware `json:"software"`
+		Protocols         []string         `json:"protocols"`
+		Services          NodeInfoServices `json:"services"`
+		OpenRegistrations bool             `json:"openRegistrations"`
+		Usage             NodeInfoUsage    `json:"usage"`
+		Metadata          map[string]any   `json:"metadata"`
+	}
+
+	NodeInfoSoftware struct {
+		Name       string `json:"name"`
+		Version    string `json:"version"`
+		Repository string `json:"repository,omitempty"` // 2.1 only
+		Homepage   string `json:"homepage,omitempty"`   // 2.1 only
+	}
+
+	NodeInfoServices struct {
+		Inbound  []string `json:"inbound"`
+		Outbound []string `json:"outbound"`
+	}
+
+	NodeInfoUsage struct {
+		Users NodeInfoUsers `json:"users"`
+	}
+
+	NodeInfoUsers struct {
+		Total int64 `json:"total"`
+	}
+
+	WebFingerResponse struct {
+		Subject string           `json:"subject"`
+		Aliases []string         `json:"aliases"`
+		Links   []*WellKnownLink `json:"links"`
+	}
+)
+
+var NODEINFO_VERSIONS = []string{"2.0", "2.1"}
+
+// handler for GET to /.well-known/nodeinfo
+func nodeInfoLinksHandler(c echo.Context) error {
+	links := &NodeInfoLinks{Links: []*WellKnownLink{}}
+	for _, v := range NODEINFO_VERSIONS {
+		links.Links = append(links.Links, &WellKnownLink{
+			Rel:  "http://nodeinfo.diaspora.software/ns/schema/" + v,
+			Href: localURL("nodeinfo", v),
+		})
+	}
+
+	return c.JSON(http.StatusOK, links)
+}
+
+// handler for GET to /nodeinfo/:version
+func nodeInfoHandler(c echo.Context) error {
+	version := c.Param("version")
+	if err := mainValidator.Var(&version, "oneof=2.0 2.1"); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	userCount, err := mainDB.Collection(COLLECTION_USER).CountDocuments(c.Request().Context(), bson.D{})
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	liveRooms, err := countLiveRooms(c.Request().Context())
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	name, softwareVersion, _ := strings.Cut(USER_AGENT, "/")
+	software := NodeInfoSoftware{
+		Name:    strings.ToLower(name),
+		Version: softwareVersion,
+	}
+	if version == "2.1" {
+		software.Repository = "https://codeberg.org/nmkj/audon"
+		software.Homepage = "https://codeberg.org/nmkj/audon"
+	}
+
+	info := &NodeInfo{
+		Version:           version,
+		Software:          software,
+		Protocols:         []string{"activitypub"},
+		Services:          NodeInfoServices{Inbound: []string{}, Outbound: []string{}},
+		OpenRegistrations: true, // anyone with a Fediverse account can log in
+		Usage:             NodeInfoUsage{Users: NodeInfoUsers{Total: userCount}},
+		Metadata: map[string]any{
+			"nodeName":  mainConfig.LocalDomain,
+			"liveRooms": liveRooms,
+		},
+	}
+
+	contentType := fmt.Sprintf(`application/json; profile="http://nodeinfo.diaspora.software/ns/schema/%s#"`, version)
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	return c.JSON(http.StatusOK, info)
+}
+
+// handler for GET to /.well-known/webfinger?resource=****
+// Resolves hosts by their actor names, their Fediverse accounts or URLs of their profiles and actors on Audon.
+func webFingerHandler(c echo.Context) error {
+	resource := c.QueryParam("resource")
+	if resource == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "resource_required")
+	}
+
+	user, err := findUserByResource(c.Request().Context(), resource)
+	if err != nil || user == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	// only hosts have public profiles
+	count, err := mainDB.Collection(COLLECTION_ROOM).CountDocuments(c.Request().Context(),
+		bson.D{{Key: "host.audon_id", Value: user.AudonID}})
+	if err != nil {
+		c.Logger().Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	resp := &WebFingerResponse{
+		Subject: fmt.Sprintf("acct:%s@%s", user.ActorName(), mainConfig.LocalDomain),
+		Aliases: []string{user.ActorURL(), user.ProfileURL(), user.RemoteURL},
+		Links: []*WellKnownLink{
+			{
+				Rel:  "http://webfinger.net/rel/profile-page",
+				Type: "text/html",
+				Href: user.ProfileURL(),
+			},
+			{
+				Rel:  "self",
+				Type: AP_CONTENT_TYPE,
+				Href: user.ActorURL(),
+			},
+		},
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/jrd+json")
+	return c.JSON(http.StatusOK, resp)
+}
+
+func findUserByResource(ctx context.Context, resource string) (*AudonUser, error) {
+	if strings.HasPrefix(resource, "acct:") {
+		acct := strings.TrimPrefix(resource, "acct:")
+		name, domain, _ := strings.Cut(strings.TrimPrefix(acct, "@"), "@")
+		if strings.EqualFold(domain, mainConfig.LocalDomain) {
+			return findUserByActorName(ctx, name)
+		}
+		return findUserByWebfinger(ctx, strings.TrimPrefix(acct, "@"))
+	}
+
+	if user, err := findUserByActorURL(ctx, resource); err == nil {
+		return user, nil
+	}
+	u, err := url.Parse(resource)
+	if err != nil || !strings.EqualFold(u.Host, mainConfig.LocalDomain) {
+		return nil, fmt.Errorf("unknown resource: %s", resource)
+	}
+	if !strings.HasPrefix(u.Path, "/u/@") {
+		return nil, fmt.Errorf("unknown resource: %s", resource)
+	}
+	return findUserByWebfinger(ctx, strings.TrimPrefix(u.Path, "/u/@"))
+}
+
+func countLiveRooms(ctx context.Context) (int, error) {
+	resp, err := lkRoomServiceClient.ListRooms(ctx, &livekit.ListRoomsRequest{})
+	if err != nil {
+		return 0, err
+	}
+	return len(resp.GetRooms()), nil
+}
+
+// Returns the URL of the user's profile on Audon, which redirects to the room the user is in
+func (a *AudonUser) ProfileURL() string {
+	return localURL("u", "@"+a.Webfinger)
+}
+
+func localURL(elem ...string) string {
+	u := &url.URL{
+		Host:   mainConfig.LocalDomain,
+		Scheme: "https",
+		Path:   "/",
+	}
+	return u.JoinPath(elem...).String()
+}